@@ -1,21 +1,28 @@
 package console
 
 import (
-	"bufio"
+	"bytes"
+	"cmp"
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/stickpro/p-router/internal/app"
 	"github.com/stickpro/p-router/internal/config"
 	"github.com/stickpro/p-router/internal/repository"
 	"github.com/stickpro/p-router/internal/router"
+	"github.com/stickpro/p-router/internal/service/checker"
+	"github.com/stickpro/p-router/internal/service/importer"
 	"github.com/stickpro/p-router/pkg/cfg"
 	"github.com/stickpro/p-router/pkg/logger"
+	utils "github.com/stickpro/p-router/pkg/util"
 	"github.com/urfave/cli/v3"
 )
 
@@ -46,86 +53,568 @@ func InitCommands(currentAppVersion, appName, _ string) []*cli.Command {
 		},
 		{
 			Name:        "import",
-			Description: "Import proxies from a file",
+			Description: "Import proxies from a file or URL and report what was done with each record",
 			Flags: []cli.Flag{
 				&cli.StringFlag{
-					Name:     "file",
-					Usage:    "Path to txt file with proxies (host:port per line)",
-					Required: true,
+					Name: "file",
+					Usage: "Path to a file with proxies: txt ([scheme://][user:pass@]host:port or host:port:user:pass per line), " +
+						"csv with a header, or a json or yaml list",
 				},
+				&cli.StringFlag{Name: "url", Usage: "URL to fetch the proxies from instead of --file"},
+				&cli.StringFlag{Name: "format", Usage: strings.Join(importer.Formats, ", ") + ", guessed from the extension if empty"},
+				&cli.StringSliceFlag{Name: "tag", Usage: "tag given to every imported proxy, repeatable"},
+				&cli.StringFlag{
+					Name:  "on-conflict",
+					Value: importer.OnConflictSkip,
+					Usage: "what to do when the username or target exists: " + strings.Join(importer.ConflictModes, ", "),
+				},
+				&cli.BoolFlag{Name: "dry-run", Usage: "report what would be done without storing anything"},
+				outputFlag(),
 				cfgPathsFlag(),
 			},
 			Action: func(ctx context.Context, command *cli.Command) error {
+				filePath, url := command.String("file"), command.String("url")
+				if (filePath == "") == (url == "") {
+					return fmt.Errorf("use either --file or --url")
+				}
+
 				conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
 				if err != nil {
 					return fmt.Errorf("failed to load config: %w", err)
 				}
-				filePath := command.String("file")
 
-				f, err := os.Open(filePath)
-				if err != nil {
+				var data []byte
+				format := importer.FormatOf(filePath)
+				if url != "" {
+					client := &http.Client{Timeout: time.Minute}
+					if data, format, err = importer.Fetch(ctx, client, url); err != nil {
+						return err
+					}
+				} else if data, err = os.ReadFile(filePath); err != nil {
 					return fmt.Errorf("failed to open file: %w", err)
 				}
-				defer f.Close()
+				if command.IsSet("format") {
+					format = command.String("format")
+				}
 
-				repo, err := repository.NewSQLiteRepository("proxies.db")
+				records, err := importer.Parse(bytes.NewReader(data), format)
+				if err != nil {
+					return err
+				}
+
+				repo, err := newRepository(command)
 				if err != nil {
 					log.Fatalf("Failed to create repository: %v", err)
 				}
 				defer repo.Close()
 
-				pr := router.NewProxyRouter(repo)
+				report, importErr := importer.Import(ctx, router.NewProxyRouter(repo), records, importer.Options{
+					OnConflict: command.String("on-conflict"),
+					DryRun:     command.Bool("dry-run"),
+					Tags:       command.StringSlice("tag"),
+				})
+				if report == nil {
+					return importErr
+				}
 
-				scanner := bufio.NewScanner(f)
-				lineNum := 0
-				for scanner.Scan() {
-					lineNum++
-					line := strings.TrimSpace(scanner.Text())
-					if line == "" {
-						continue
+				type importOutput struct {
+					Line     int    `json:"line"`
+					Action   string `json:"action"`
+					Username string `json:"username,omitempty"`
+					Target   string `json:"target"`
+					Reason   string `json:"reason,omitempty"`
+					URL      string `json:"url,omitempty"`
+				}
+				rows := make([]importOutput, 0, len(report.Results))
+				for _, result := range report.Results {
+					row := importOutput{Line: result.Line, Action: result.Action, Username: result.Username, Target: result.Target, Reason: result.Reason}
+					if result.Action == importer.ActionCreated || result.Action == importer.ActionUpdated {
+						row.URL = proxyURL(conf, result.Username, result.Password)
 					}
+					rows = append(rows, row)
+				}
+				if err := printList(os.Stdout, command.String("output"), []string{"line", "action", "username", "target", "reason", "url"}, rows,
+					func(row importOutput) []string {
+						return []string{strconv.Itoa(row.Line), row.Action, row.Username, row.Target, row.Reason, row.URL}
+					}); err != nil {
+					return err
+				}
 
-					// ожидаем host:port
-					if !strings.Contains(line, ":") {
-						fmt.Printf("skip line %d: invalid format\n", lineNum)
-						continue
-					}
+				summary := fmt.Sprintf("created: %d updated: %d skipped: %d failed: %d", report.Created, report.Updated, report.Skipped, report.Failed)
+				if command.Bool("dry-run") {
+					summary += " (dry run, nothing was stored)"
+				}
+				fmt.Fprintln(os.Stderr, summary)
 
-					username := randomString(8)
-					password := randomString(12)
+				if importErr != nil {
+					return cli.Exit(importErr.Error(), 1)
+				}
+				if report.Failed > 0 {
+					return cli.Exit(fmt.Sprintf("%d records failed", report.Failed), 1)
+				}
+				return nil
+			},
+		},
+		proxyListCommand("proxy-list"),
+		proxyCommand(),
+		rotateCredentialsCommand(),
+		exportCommand(),
+		migrateCommand(),
+		{
+			Name:        "pool",
+			Description: "Manage pools of upstream proxies behind a single credential",
+			Commands: []*cli.Command{
+				{
+					Name:        "create",
+					Description: "Create a pool",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "name", Required: true},
+						&cli.StringFlag{Name: "strategy", Value: router.StrategyRoundRobin, Usage: strings.Join(router.Strategies, ", ")},
+						&cli.StringFlag{Name: "username", Usage: "router username, random if empty"},
+						&cli.StringFlag{Name: "password", Usage: "router password, random if empty"},
+						cfgPathsFlag(),
+					},
+					Action: func(ctx context.Context, command *cli.Command) error {
+						conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+						if err != nil {
+							return fmt.Errorf("failed to load config: %w", err)
+						}
 
-					if err := pr.AddProxy(username, password, line); err != nil {
-						continue
-					}
+						repo, err := newRepository(command)
+						if err != nil {
+							log.Fatalf("Failed to create repository: %v", err)
+						}
+						defer repo.Close()
+
+						pool := &router.PoolConfig{
+							Name:     command.String("name"),
+							Username: command.String("username"),
+							Password: command.String("password"),
+							Strategy: command.String("strategy"),
+						}
+						if pool.Username == "" {
+							pool.Username = utils.RandomString(8)
+						}
+						if pool.Password == "" {
+							pool.Password = utils.RandomString(12)
+						}
+
+						pr := router.NewProxyRouter(repo)
+						if err := pr.AddPool(ctx, pool); err != nil {
+							return fmt.Errorf("failed to create pool: %w", err)
+						}
+
+						fmt.Println(proxyURL(conf, pool.Username, pool.Password))
+						return nil
+					},
+				},
+				{
+					Name:        "delete",
+					Description: "Delete a pool, its member proxies are kept",
+					Flags:       []cli.Flag{&cli.StringFlag{Name: "name", Required: true}, cfgPathsFlag()},
+					Action: func(ctx context.Context, command *cli.Command) error {
+						repo, err := newRepository(command)
+						if err != nil {
+							log.Fatalf("Failed to create repository: %v", err)
+						}
+						defer repo.Close()
+
+						return router.NewProxyRouter(repo).RemovePool(ctx, command.String("name"))
+					},
+				},
+				{
+					Name:        "add",
+					Description: "Add proxies to a pool by their router usernames",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "name", Required: true},
+						&cli.StringSliceFlag{Name: "proxy", Required: true},
+						cfgPathsFlag(),
+					},
+					Action: func(ctx context.Context, command *cli.Command) error {
+						repo, err := newRepository(command)
+						if err != nil {
+							log.Fatalf("Failed to create repository: %v", err)
+						}
+						defer repo.Close()
+
+						pr := router.NewProxyRouter(repo)
+						for _, username := range command.StringSlice("proxy") {
+							if err := pr.AddPoolMember(ctx, command.String("name"), username); err != nil {
+								return fmt.Errorf("failed to add %s: %w", username, err)
+							}
+						}
+						return nil
+					},
+				},
+				{
+					Name:        "remove",
+					Description: "Remove proxies from a pool",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "name", Required: true},
+						&cli.StringSliceFlag{Name: "proxy", Required: true},
+						cfgPathsFlag(),
+					},
+					Action: func(ctx context.Context, command *cli.Command) error {
+						repo, err := newRepository(command)
+						if err != nil {
+							log.Fatalf("Failed to create repository: %v", err)
+						}
+						defer repo.Close()
+
+						pr := router.NewProxyRouter(repo)
+						for _, username := range command.StringSlice("proxy") {
+							if err := pr.RemovePoolMember(ctx, command.String("name"), username); err != nil {
+								return fmt.Errorf("failed to remove %s: %w", username, err)
+							}
+						}
+						return nil
+					},
+				},
+				{
+					Name:        "list",
+					Description: "List pools with their members",
+					Flags:       []cli.Flag{outputFlag(), cfgPathsFlag()},
+					Action: func(ctx context.Context, command *cli.Command) error {
+						repo, err := newRepository(command)
+						if err != nil {
+							log.Fatalf("Failed to create repository: %v", err)
+						}
+						defer repo.Close()
+
+						type poolOutput struct {
+							Name     string   `json:"name"`
+							Username string   `json:"username"`
+							Strategy string   `json:"strategy"`
+							Members  []string `json:"members"`
+						}
+						var pools []poolOutput
+						for _, pool := range router.NewProxyRouter(repo).GetAllPools() {
+							pools = append(pools, poolOutput{pool.Name, pool.Username, pool.Strategy, pool.Members})
+						}
+						slices.SortFunc(pools, func(a, b poolOutput) int { return strings.Compare(a.Name, b.Name) })
+
+						return printList(os.Stdout, command.String("output"), []string{"name", "username", "strategy", "members"}, pools,
+							func(p poolOutput) []string {
+								return []string{p.Name, p.Username, p.Strategy, strings.Join(p.Members, ",")}
+							})
+					},
+				},
+			},
+		},
+		{
+			Name:        "tags",
+			Description: "Manage the tags clients select proxies by",
+			Commands: []*cli.Command{
+				{
+					Name:        "set",
+					Description: "Replace the tags of a proxy, no tag clears them",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "username", Required: true},
+						&cli.StringSliceFlag{Name: "tag", Usage: "repeatable"},
+						cfgPathsFlag(),
+					},
+					Action: func(ctx context.Context, command *cli.Command) error {
+						repo, err := newRepository(command)
+						if err != nil {
+							log.Fatalf("Failed to create repository: %v", err)
+						}
+						defer repo.Close()
+
+						return router.NewProxyRouter(repo).SetTags(ctx, command.String("username"), command.StringSlice("tag"))
+					},
+				},
+				{
+					Name:        "list",
+					Description: "List proxies with their tags and exit location",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "tag", Usage: "only list proxies with this tag"},
+						outputFlag(),
+						cfgPathsFlag(),
+					},
+					Action: func(ctx context.Context, command *cli.Command) error {
+						repo, err := newRepository(command)
+						if err != nil {
+							log.Fatalf("Failed to create repository: %v", err)
+						}
+						defer repo.Close()
+
+						models, err := repo.FindAll(ctx)
+						if err != nil {
+							return err
+						}
+
+						type tagsOutput struct {
+							Username  string   `json:"username"`
+							Country   string   `json:"country,omitempty"`
+							ASN       uint     `json:"asn,omitempty"`
+							Anonymity string   `json:"anonymity,omitempty"`
+							Tags      []string `json:"tags"`
+						}
+						tag := strings.ToLower(command.String("tag"))
+						var list []tagsOutput
+						for _, model := range models {
+							if tag != "" && !slices.Contains(model.Tags, tag) {
+								continue
+							}
+							list = append(list, tagsOutput{model.Username, model.Exit.Country, model.Exit.ASN, model.Exit.Anonymity, model.Tags})
+						}
+
+						return printList(os.Stdout, command.String("output"), []string{"username", "country", "asn", "anonymity", "tags"}, list,
+							func(t tagsOutput) []string {
+								return []string{t.Username, t.Country, strconv.FormatUint(uint64(t.ASN), 10), t.Anonymity, strings.Join(t.Tags, ",")}
+							})
+					},
+				},
+			},
+		},
+		{
+			Name:        "limits",
+			Description: "Manage rate limits and tunnel caps of proxy and pool users",
+			Commands: []*cli.Command{
+				{
+					Name:        "set",
+					Description: "Set the limits of a user, 0 falls back to the global default",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "username", Required: true},
+						&cli.FloatFlag{Name: "rate", Usage: "requests and new tunnels per second"},
+						&cli.IntFlag{Name: "burst", Usage: "requests allowed at once above the rate"},
+						&cli.IntFlag{Name: "max-conns", Usage: "concurrent tunnels"},
+						&cli.Int64Flag{Name: "daily-quota", Usage: "bytes per UTC day, 0 is no quota"},
+						&cli.Int64Flag{Name: "monthly-quota", Usage: "bytes per UTC month, 0 is no quota"},
+						cfgPathsFlag(),
+					},
+					Action: func(ctx context.Context, command *cli.Command) error {
+						repo, err := newRepository(command)
+						if err != nil {
+							log.Fatalf("Failed to create repository: %v", err)
+						}
+						defer repo.Close()
+
+						pr := router.NewProxyRouter(repo)
+						limits, err := pr.GetLimits(command.String("username"))
+						if err != nil {
+							return err
+						}
+						if command.IsSet("rate") {
+							limits.RateLimit = command.Float("rate")
+						}
+						if command.IsSet("burst") {
+							limits.RateBurst = command.Int("burst")
+						}
+						if command.IsSet("max-conns") {
+							limits.MaxConns = command.Int("max-conns")
+						}
+						if command.IsSet("daily-quota") {
+							limits.DailyQuota = command.Int64("daily-quota")
+						}
+						if command.IsSet("monthly-quota") {
+							limits.MonthlyQuota = command.Int64("monthly-quota")
+						}
+
+						return pr.SetLimits(ctx, command.String("username"), limits)
+					},
+				},
+				{
+					Name:        "show",
+					Description: "Show the limits of a user",
+					Flags:       []cli.Flag{&cli.StringFlag{Name: "username", Required: true}, cfgPathsFlag()},
+					Action: func(ctx context.Context, command *cli.Command) error {
+						repo, err := newRepository(command)
+						if err != nil {
+							log.Fatalf("Failed to create repository: %v", err)
+						}
+						defer repo.Close()
+
+						limits, err := router.NewProxyRouter(repo).GetLimits(command.String("username"))
+						if err != nil {
+							return err
+						}
+
+						fmt.Printf("rate: %g/s burst: %d max conns: %d daily quota: %d monthly quota: %d\n",
+							limits.RateLimit, limits.RateBurst, limits.MaxConns, limits.DailyQuota, limits.MonthlyQuota)
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:        "check",
+			Description: "Check proxies once and exit with status 1 if any failed",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{Name: "username", Usage: "only check this proxy, even when disabled, repeatable"},
+				&cli.StringFlag{Name: "target", Usage: "only check proxies whose target contains this"},
+				outputFlag(),
+				&cli.BoolFlag{Name: "dry-run", Usage: "do not store results, change statuses or delete proxies"},
+				&cli.BoolFlag{Name: "verbose", Usage: "log the progress of the checker"},
+				cfgPathsFlag(),
+			},
+			Action: func(ctx context.Context, command *cli.Command) error {
+				conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
 
-					fmt.Printf("%s:%s@%s:%s \n", username, password, conf.HTTP.Host, conf.HTTP.Port)
+				loggerOpts := append(defaultLoggerOpts(appName, currentAppVersion), logger.WithConfig(conf.Log))
+				if !command.Bool("verbose") {
+					loggerOpts = append(loggerOpts, logger.WithLogLevel(logger.LogLevelFatal))
+				}
+				l := logger.NewExtended(loggerOpts...)
+				defer func() {
+					_ = l.Sync()
+				}()
+
+				repo, err := newRepository(command)
+				if err != nil {
+					log.Fatalf("Failed to create repository: %v", err)
+				}
+				defer repo.Close()
+
+				geoip, err := checker.OpenGeoIP(conf.Checker.GeoIPCountryDB, conf.Checker.GeoIPASNDB)
+				if err != nil {
+					return fmt.Errorf("failed to open GeoIP databases: %w", err)
+				}
+				defer geoip.Close()
+
+				results, err := checker.New(conf, l, repo, checker.WithGeoIP(geoip)).CheckSelected(ctx, checker.CheckOptions{
+					Usernames: command.StringSlice("username"),
+					Target:    command.String("target"),
+					DryRun:    command.Bool("dry-run"),
+				})
+				if err != nil {
+					return err
 				}
-				if err := scanner.Err(); err != nil {
-					return fmt.Errorf("failed to read file: %w", err)
+				if len(results) == 0 {
+					return cli.Exit("no proxies matched", 2)
 				}
 
+				if err := printCheckResults(os.Stdout, results, command.String("output")); err != nil {
+					return err
+				}
+
+				failed := 0
+				for _, result := range results {
+					if !result.Success {
+						failed++
+					}
+				}
+				if failed > 0 {
+					return cli.Exit(fmt.Sprintf("%d of %d proxies failed", failed, len(results)), 1)
+				}
 				return nil
 			},
 		},
 		{
-			Name:        "proxy-list",
-			Description: "List all proxies",
-			Flags:       []cli.Flag{cfgPathsFlag()},
+			Name:        "proxy-stats",
+			Description: "Print uptime and check latency percentiles per proxy",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{Name: "since", Value: 24 * time.Hour, Usage: "how far back to look"},
+				&cli.StringFlag{Name: "username", Usage: "only report this proxy"},
+				outputFlag(),
+				cfgPathsFlag(),
+			},
 			Action: func(ctx context.Context, command *cli.Command) error {
-				conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+				repo, err := newRepository(command)
+				if err != nil {
+					log.Fatalf("Failed to create repository: %v", err)
+				}
+				defer repo.Close()
 
-				repo, err := repository.NewSQLiteRepository("proxies.db")
+				checks, err := repo.FindChecks(ctx, command.String("username"), time.Now().Add(-command.Duration("since")))
+				if err != nil {
+					return err
+				}
+
+				type statsOutput struct {
+					Username string  `json:"username"`
+					Checks   int     `json:"checks"`
+					Uptime   float64 `json:"uptime"`
+					P50Ms    int64   `json:"p50_ms"`
+					P95Ms    int64   `json:"p95_ms"`
+				}
+				var list []statsOutput
+				for _, stats := range repository.SummarizeChecks(checks) {
+					list = append(list, statsOutput{stats.Username, stats.Checks, stats.Uptime(), stats.P50.Milliseconds(), stats.P95.Milliseconds()})
+				}
+
+				return printList(os.Stdout, command.String("output"), []string{"username", "checks", "uptime", "p50_ms", "p95_ms"}, list,
+					func(s statsOutput) []string {
+						return []string{s.Username, strconv.Itoa(s.Checks), strconv.FormatFloat(s.Uptime, 'f', 2, 64),
+							strconv.FormatInt(s.P50Ms, 10), strconv.FormatInt(s.P95Ms, 10)}
+					})
+			},
+		},
+		{
+			Name:        "usage",
+			Description: "Print bytes moved per user, and per upstream with --by-upstream",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "since", Usage: "first UTC day to include (YYYY-MM-DD), the current month if empty"},
+				&cli.StringFlag{Name: "username", Usage: "only report this user"},
+				&cli.BoolFlag{Name: "by-upstream"},
+				outputFlag(),
+				cfgPathsFlag(),
+			},
+			Action: func(ctx context.Context, command *cli.Command) error {
+				since := command.String("since")
+				if since == "" {
+					since = time.Now().UTC().Format("2006-01") + "-01"
+				} else if _, err := time.Parse("2006-01-02", since); err != nil {
+					return fmt.Errorf("invalid --since: %w", err)
+				}
+
+				repo, err := newRepository(command)
 				if err != nil {
 					log.Fatalf("Failed to create repository: %v", err)
 				}
 				defer repo.Close()
 
-				pr := router.NewProxyRouter(repo)
-				list, _ := pr.GetAllProxies()
-				for _, prx := range list {
-					fmt.Printf("%s:%s@%s:%d\n", prx.Username, prx.Password, conf.HTTP.Host, conf.HTTP.Port)
+				records, err := repo.FindUsage(ctx, since)
+				if err != nil {
+					return err
+				}
+
+				type usageRow struct {
+					Username  string `json:"username"`
+					Upstream  string `json:"upstream,omitempty"`
+					BytesUp   int64  `json:"bytes_up"`
+					BytesDown int64  `json:"bytes_down"`
+					Total     int64  `json:"total"`
 				}
-				return nil
+				var rows []*usageRow
+				byKey := make(map[string]*usageRow)
+				for _, record := range records {
+					if username := command.String("username"); username != "" && record.Username != username {
+						continue
+					}
+					key := usageRow{Username: record.Username}
+					if command.Bool("by-upstream") {
+						key.Upstream = record.Upstream
+					}
+					row, exists := byKey[key.Username+" "+key.Upstream]
+					if !exists {
+						row = &key
+						byKey[key.Username+" "+key.Upstream] = row
+						rows = append(rows, row)
+					}
+					row.BytesUp += record.BytesUp
+					row.BytesDown += record.BytesDown
+					row.Total = row.BytesUp + row.BytesDown
+				}
+
+				slices.SortFunc(rows, func(a, b *usageRow) int {
+					return cmp.Or(strings.Compare(a.Username, b.Username), strings.Compare(a.Upstream, b.Upstream))
+				})
+
+				header := []string{"username", "up", "down", "total"}
+				if command.Bool("by-upstream") {
+					header = slices.Insert(header, 1, "upstream")
+				}
+				return printList(os.Stdout, command.String("output"), header, rows, func(row *usageRow) []string {
+					cells := []string{row.Username, strconv.FormatInt(row.BytesUp, 10), strconv.FormatInt(row.BytesDown, 10), strconv.FormatInt(row.Total, 10)}
+					if command.Bool("by-upstream") {
+						cells = slices.Insert(cells, 1, row.Upstream)
+					}
+					return cells
+				})
 			},
 		},
 	}
@@ -140,6 +629,17 @@ func cfgPathsFlag() *cli.StringSliceFlag {
 	}
 }
 
+// newRepository opens the storage configured for command and applies pending
+// migrations.
+func newRepository(command *cli.Command) (repository.IProxyRepository, error) {
+	conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+	if err != nil {
+		return nil, err
+	}
+
+	return repository.New(conf.Storage.Driver, conf.Storage.DSN)
+}
+
 func loadConfig(args, configPaths []string) (*config.Config, error) {
 	conf := new(config.Config)
 	if err := cfg.Load(conf,
@@ -162,8 +662,40 @@ func defaultLoggerOpts(appName, version string) []logger.Option {
 	}
 }
 
-func randomString(n int) string {
-	b := make([]byte, n)
-	_, _ = rand.Read(b)
-	return hex.EncodeToString(b)[:n]
+type checkOutput struct {
+	Username   string `json:"username"`
+	Target     string `json:"target"`
+	Success    bool   `json:"success"`
+	LatencyMs  int64  `json:"latency_ms"`
+	StatusCode int    `json:"status_code,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// printCheckResults writes check results to w in the output format.
+func printCheckResults(w io.Writer, results []checker.CheckResult, output string) error {
+	rows := make([]checkOutput, 0, len(results))
+	for _, result := range results {
+		row := checkOutput{
+			Username:   result.Username,
+			Target:     result.Target,
+			Success:    result.Success,
+			LatencyMs:  result.Latency.Milliseconds(),
+			StatusCode: result.StatusCode,
+			ErrorClass: result.ErrorClass,
+		}
+		if result.Error != nil {
+			row.Error = result.Error.Error()
+		}
+		rows = append(rows, row)
+	}
+
+	header := []string{"username", "target", "result", "latency_ms", "status", "error"}
+	return printList(w, output, header, rows, func(row checkOutput) []string {
+		result := "ok"
+		if !row.Success {
+			result = "failed"
+		}
+		return []string{row.Username, row.Target, result, strconv.FormatInt(row.LatencyMs, 10), strconv.Itoa(row.StatusCode), row.Error}
+	})
 }
@@ -0,0 +1,268 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/stickpro/p-router/internal/config"
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/router"
+	utils "github.com/stickpro/p-router/pkg/util"
+	"github.com/urfave/cli/v3"
+)
+
+// Export formats.
+const (
+	exportURLs = "urls"
+	exportCSV  = "csv"
+	exportJSON = "json"
+	exportEnv  = "env"
+	exportPAC  = "pac"
+)
+
+var exportFormats = []string{exportURLs, exportCSV, exportJSON, exportEnv, exportPAC}
+
+// Health of a proxy as seen by the checker.
+const (
+	healthHealthy   = "healthy"
+	healthFailing   = "failing"
+	healthUnchecked = "unchecked"
+)
+
+// exportEntry is a credential clients log in to the router with.
+type exportEntry struct {
+	Username string   `json:"username"`
+	Password string   `json:"password,omitempty"`
+	Host     string   `json:"host"`
+	Port     string   `json:"port"`
+	URL      string   `json:"url"`
+	Status   string   `json:"status,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Pool     string   `json:"pool,omitempty"`
+}
+
+func proxyHealth(model *repository.ProxyModel) string {
+	switch {
+	case model.LastCheckAt == "":
+		return healthUnchecked
+	case model.FailedChecks > 0:
+		return healthFailing
+	}
+	return healthHealthy
+}
+
+func exportCommand() *cli.Command {
+	return &cli.Command{
+		Name:        "export",
+		Description: "Write the credentials clients log in with, as URLs, CSV, JSON, shell env files or a PAC file. Stored passwords are hashed, so only --rotate includes passwords",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "format", Value: exportURLs, Usage: strings.Join(exportFormats, ", ")},
+			&cli.StringFlag{Name: "scheme", Value: "http", Usage: "http or socks5, the listener clients connect to"},
+			&cli.StringSliceFlag{Name: "username", Usage: "only export this user, repeatable"},
+			&cli.StringSliceFlag{Name: "status", Usage: "only export proxies with this status, repeatable"},
+			&cli.StringSliceFlag{Name: "tag", Usage: "only export proxies with all these tags, repeatable"},
+			&cli.StringFlag{Name: "health", Usage: "only export proxies whose last check is " + strings.Join([]string{healthHealthy, healthFailing, healthUnchecked}, ", ")},
+			&cli.BoolFlag{Name: "pools", Usage: "export pool users too, status, tag and health filters do not apply to them"},
+			&cli.BoolFlag{Name: "rotate", Usage: "give the exported users new passwords and include them, without it URLs carry no password"},
+			&cli.StringFlag{Name: "out", Usage: "file to write, stdout if empty"},
+			cfgPathsFlag(),
+		},
+		Action: func(ctx context.Context, command *cli.Command) error {
+			format := command.String("format")
+			if !slices.Contains(exportFormats, format) {
+				return fmt.Errorf("invalid --format %q, use %s", format, strings.Join(exportFormats, ", "))
+			}
+			health := command.String("health")
+			if health != "" && health != healthHealthy && health != healthFailing && health != healthUnchecked {
+				return fmt.Errorf("invalid --health %q", health)
+			}
+			tags, err := router.NormalizeTags(command.StringSlice("tag"))
+			if err != nil {
+				return err
+			}
+
+			conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			scheme, port := command.String("scheme"), conf.HTTP.Port
+			switch scheme {
+			case "http":
+			case "socks5":
+				if !conf.Socks5.Enabled {
+					return fmt.Errorf("the SOCKS5 listener is disabled, enable socks5.enabled")
+				}
+				port = conf.Socks5.Port
+			default:
+				return fmt.Errorf("invalid --scheme %q, use http or socks5", scheme)
+			}
+
+			repo, err := newRepository(command)
+			if err != nil {
+				log.Fatalf("Failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			pr := router.NewProxyRouter(repo)
+			models, err := pr.FindProxies(ctx)
+			if err != nil {
+				return err
+			}
+
+			usernames, statuses := command.StringSlice("username"), command.StringSlice("status")
+			entry := func(username string) exportEntry {
+				return exportEntry{Username: username, Host: conf.PublicHost(), Port: port}
+			}
+
+			var entries []exportEntry
+			for _, model := range models {
+				if len(usernames) > 0 && !slices.Contains(usernames, model.Username) ||
+					len(statuses) > 0 && !slices.Contains(statuses, model.Status) ||
+					health != "" && proxyHealth(model) != health ||
+					slices.ContainsFunc(tags, func(tag string) bool { return !slices.Contains(model.Tags, tag) }) {
+					continue
+				}
+				e := entry(model.Username)
+				e.Status, e.Tags = model.Status, model.Tags
+				entries = append(entries, e)
+			}
+			if command.Bool("pools") {
+				pools := pr.GetAllPools()
+				slices.SortFunc(pools, func(a, b *router.PoolConfig) int { return strings.Compare(a.Username, b.Username) })
+				for _, pool := range pools {
+					if len(usernames) > 0 && !slices.Contains(usernames, pool.Username) {
+						continue
+					}
+					e := entry(pool.Username)
+					e.Pool = pool.Name
+					entries = append(entries, e)
+				}
+			}
+			if len(entries) == 0 {
+				return cli.Exit("no proxies matched", 2)
+			}
+
+			passwords := make(map[string]string)
+			for i := range entries {
+				e := &entries[i]
+				if command.Bool("rotate") {
+					e.Password = utils.RandomString(12)
+					passwords[e.Username] = e.Password
+				}
+
+				u := url.URL{Scheme: scheme, User: url.User(e.Username), Host: net.JoinHostPort(e.Host, e.Port)}
+				if e.Password != "" {
+					u.User = url.UserPassword(e.Username, e.Password)
+				}
+				e.URL = u.String()
+			}
+
+			var buf bytes.Buffer
+			if err := writeExport(&buf, format, conf, scheme, port, entries); err != nil {
+				return err
+			}
+
+			// New passwords are stored only once they are written out, so
+			// that a failed write locks nobody out.
+			path := command.String("out")
+			if path == "" {
+				if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+					return err
+				}
+			} else if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+				return err
+			}
+
+			if len(passwords) > 0 {
+				if err := pr.SetPasswords(ctx, passwords); err != nil {
+					if path != "" {
+						_ = os.Remove(path)
+					}
+					return fmt.Errorf("failed to rotate passwords, none were changed: %w", err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path, readable
+// only by its owner, and renames it to path once it is complete.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeExport(w io.Writer, format string, conf *config.Config, scheme, port string, entries []exportEntry) error {
+	switch format {
+	case exportCSV, exportJSON:
+		header := []string{"username", "password", "host", "port", "url", "status", "tags", "pool"}
+		return printList(w, format, header, entries, func(e exportEntry) []string {
+			return []string{e.Username, e.Password, e.Host, e.Port, e.URL, e.Status, strings.Join(e.Tags, ","), e.Pool}
+		})
+	case exportEnv:
+		// One block per user, a file exporting a single user can be sourced
+		// before running curl and most other HTTP clients.
+		for i, e := range entries {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "# %s\n", e.Username)
+			for _, name := range []string{"http_proxy", "https_proxy", "all_proxy", "HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY"} {
+				fmt.Fprintf(w, "export %s=%s\n", name, shellQuote(e.URL))
+			}
+		}
+		return nil
+	case exportPAC:
+		// PAC files cannot carry credentials, browsers ask for them when the
+		// router answers 407.
+		directive := "PROXY"
+		if scheme == "socks5" {
+			directive = "SOCKS5"
+		}
+		_, err := fmt.Fprintf(w, `function FindProxyForURL(url, host) {
+  if (isPlainHostName(host) || host === "localhost" || host === "127.0.0.1") {
+    return "DIRECT";
+  }
+  return "%s %s";
+}
+`, directive, net.JoinHostPort(conf.PublicHost(), port))
+		return err
+	}
+
+	for _, e := range entries {
+		if _, err := fmt.Fprintln(w, e.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
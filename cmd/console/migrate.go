@@ -0,0 +1,101 @@
+package console
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/urfave/cli/v3"
+)
+
+func migrateCommand() *cli.Command {
+	return &cli.Command{
+		Name:        "migrate",
+		Description: "Manage the database schema, other commands apply pending migrations when they open it",
+		Commands: []*cli.Command{
+			{
+				Name:        "up",
+				Description: "Apply the pending migrations",
+				Flags:       []cli.Flag{cfgPathsFlag()},
+				Action: func(ctx context.Context, command *cli.Command) error {
+					migrator, closeRepo, err := openMigrator(command)
+					if err != nil {
+						return err
+					}
+					defer closeRepo()
+
+					applied, err := migrator.Migrate()
+					for _, status := range applied {
+						fmt.Printf("applied %d %s\n", status.Version, status.Name)
+					}
+					if err != nil {
+						return cli.Exit(err.Error(), 1)
+					}
+					if len(applied) == 0 {
+						fmt.Println("schema is up to date")
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "status",
+				Description: "List the migrations and when they were applied",
+				Flags:       []cli.Flag{outputFlag(), cfgPathsFlag()},
+				Action: func(ctx context.Context, command *cli.Command) error {
+					migrator, closeRepo, err := openMigrator(command)
+					if err != nil {
+						return err
+					}
+					defer closeRepo()
+
+					statuses, err := migrator.MigrationStatus()
+					if err != nil && !errors.Is(err, repository.ErrSchemaTooNew) {
+						return err
+					}
+					if perr := printList(os.Stdout, command.String("output"), []string{"version", "name", "applied_at"}, statuses,
+						func(s repository.MigrationStatus) []string {
+							appliedAt := s.AppliedAt
+							if !s.Applied() {
+								appliedAt = "pending"
+							}
+							return []string{strconv.Itoa(s.Version), s.Name, appliedAt}
+						}); perr != nil {
+						return perr
+					}
+					if err != nil {
+						return cli.Exit(err.Error(), 1)
+					}
+					if !slices.ContainsFunc(statuses, repository.MigrationStatus.Applied) {
+						fmt.Fprintln(os.Stderr, "no migrations applied")
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// openMigrator opens the configured storage without migrating it.
+func openMigrator(command *cli.Command) (repository.Migrator, func() error, error) {
+	conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	repo, err := repository.Open(conf.Storage.Driver, conf.Storage.DSN)
+	if err != nil {
+		log.Fatalf("Failed to create repository: %v", err)
+	}
+
+	migrator, ok := repo.(repository.Migrator)
+	if !ok {
+		repo.Close()
+		return nil, nil, fmt.Errorf("the %s storage has no schema to migrate", conf.Storage.Driver)
+	}
+	return migrator, repo.Close, nil
+}
@@ -0,0 +1,63 @@
+package console
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/goccy/go-json"
+	"github.com/urfave/cli/v3"
+)
+
+// Output formats of listing commands.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputCSV   = "csv"
+)
+
+func outputFlag() *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:  "output",
+		Value: outputTable,
+		Usage: "table, json or csv",
+		Validator: func(output string) error {
+			switch output {
+			case outputTable, outputJSON, outputCSV:
+				return nil
+			}
+			return fmt.Errorf("invalid output %q, use table, json or csv", output)
+		},
+	}
+}
+
+// printList writes items to w in the output format. Tables and CSV get one
+// row per item with the columns in header, JSON gets the items themselves.
+func printList[T any](w io.Writer, output string, header []string, items []T, row func(T) []string) error {
+	switch output {
+	case outputJSON:
+		if items == nil {
+			items = []T{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(items)
+	case outputCSV:
+		cw := csv.NewWriter(w)
+		_ = cw.Write(header)
+		for _, item := range items {
+			_ = cw.Write(row(item))
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+	for _, item := range items {
+		fmt.Fprintln(tw, strings.Join(row(item), "\t"))
+	}
+	return tw.Flush()
+}
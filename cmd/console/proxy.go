@@ -0,0 +1,401 @@
+package console
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/stickpro/p-router/internal/config"
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/router"
+	"github.com/stickpro/p-router/internal/service/importer"
+	utils "github.com/stickpro/p-router/pkg/util"
+	"github.com/urfave/cli/v3"
+)
+
+type proxyOutput struct {
+	Username         string   `json:"username"`
+	Target           string   `json:"target"`
+	UpstreamUsername string   `json:"upstream_username,omitempty"`
+	Status           string   `json:"status"`
+	ExitIP           string   `json:"exit_ip,omitempty"`
+	Country          string   `json:"country,omitempty"`
+	ASN              uint     `json:"asn,omitempty"`
+	Anonymity        string   `json:"anonymity,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	FailedChecks     int      `json:"failed_checks"`
+	LastCheckAt      string   `json:"last_check_at,omitempty"`
+	URL              string   `json:"url"`
+}
+
+func newProxyOutput(conf *config.Config, model *repository.ProxyModel) proxyOutput {
+	return proxyOutput{
+		Username:         model.Username,
+		Target:           model.Target,
+		UpstreamUsername: model.UpstreamUsername,
+		Status:           model.Status,
+		ExitIP:           model.Exit.IP,
+		Country:          model.Exit.Country,
+		ASN:              model.Exit.ASN,
+		Anonymity:        model.Exit.Anonymity,
+		Tags:             model.Tags,
+		FailedChecks:     model.FailedChecks,
+		LastCheckAt:      model.LastCheckAt,
+		URL:              proxyURL(conf, model.Username, ""),
+	}
+}
+
+var proxyHeader = []string{"username", "target", "status", "country", "tags", "failed_checks", "url"}
+
+func (p proxyOutput) row() []string {
+	return []string{p.Username, p.Target, p.Status, p.Country, strings.Join(p.Tags, ","), strconv.Itoa(p.FailedChecks), p.URL}
+}
+
+// proxyURL is what clients put in their proxy settings to log in as username.
+// Stored passwords are hashed, an empty password is left out.
+func proxyURL(conf *config.Config, username, password string) string {
+	if password == "" {
+		return fmt.Sprintf("%s@%s:%s", username, conf.PublicHost(), conf.HTTP.Port)
+	}
+	return fmt.Sprintf("%s:%s@%s:%s", username, password, conf.PublicHost(), conf.HTTP.Port)
+}
+
+func proxyListCommand(name string) *cli.Command {
+	return &cli.Command{
+		Name:        name,
+		Description: "List proxies",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "status", Usage: "only list proxies with this status"},
+			&cli.StringFlag{Name: "tag", Usage: "only list proxies with this tag"},
+			outputFlag(),
+			cfgPathsFlag(),
+		},
+		Action: func(ctx context.Context, command *cli.Command) error {
+			conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			repo, err := newRepository(command)
+			if err != nil {
+				log.Fatalf("Failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			models, err := router.NewProxyRouter(repo).FindProxies(ctx)
+			if err != nil {
+				return err
+			}
+
+			status, tag := command.String("status"), strings.ToLower(command.String("tag"))
+			var list []proxyOutput
+			for _, model := range models {
+				if status != "" && model.Status != status || tag != "" && !slices.Contains(model.Tags, tag) {
+					continue
+				}
+				list = append(list, newProxyOutput(conf, model))
+			}
+
+			return printList(os.Stdout, command.String("output"), proxyHeader, list, proxyOutput.row)
+		},
+	}
+}
+
+func proxyCommand() *cli.Command {
+	return &cli.Command{
+		Name:        "proxy",
+		Description: "Manage proxies",
+		Commands: []*cli.Command{
+			proxyListCommand("list"),
+			{
+				Name:        "add",
+				Description: "Add a proxy and print the URL clients log in with",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "target", Required: true, Usage: "upstream in any import line format"},
+					&cli.StringFlag{Name: "username", Usage: "router username, random if empty"},
+					&cli.StringFlag{Name: "password", Usage: "router password, random if empty"},
+					&cli.StringFlag{Name: "upstream-username", Usage: "overrides credentials in --target"},
+					&cli.StringFlag{Name: "upstream-password", Usage: "overrides credentials in --target"},
+					&cli.StringSliceFlag{Name: "tag", Usage: "repeatable"},
+					cfgPathsFlag(),
+				},
+				Action: func(ctx context.Context, command *cli.Command) error {
+					conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					target, upstreamUser, upstreamPass, err := importer.ParseLine(command.String("target"))
+					if err != nil {
+						return fmt.Errorf("invalid --target: %w", err)
+					}
+
+					proxy := &router.ProxyConfig{
+						Username:         command.String("username"),
+						Password:         command.String("password"),
+						Target:           target,
+						UpstreamUsername: upstreamUser,
+						UpstreamPassword: upstreamPass,
+						Tags:             command.StringSlice("tag"),
+					}
+					if proxy.Username == "" {
+						proxy.Username = utils.RandomString(8)
+					}
+					if proxy.Password == "" {
+						proxy.Password = utils.RandomString(12)
+					}
+					if command.IsSet("upstream-username") {
+						proxy.UpstreamUsername = command.String("upstream-username")
+					}
+					if command.IsSet("upstream-password") {
+						proxy.UpstreamPassword = command.String("upstream-password")
+					}
+
+					repo, err := newRepository(command)
+					if err != nil {
+						log.Fatalf("Failed to create repository: %v", err)
+					}
+					defer repo.Close()
+
+					if err := router.NewProxyRouter(repo).AddProxy(ctx, proxy); err != nil {
+						return fmt.Errorf("failed to add proxy: %w", err)
+					}
+
+					fmt.Println(proxyURL(conf, proxy.Username, proxy.Password))
+					return nil
+				},
+			},
+			{
+				Name:        "update",
+				Description: "Change a proxy, flags that are not set keep their value",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "username", Required: true},
+					&cli.StringFlag{Name: "password"},
+					&cli.StringFlag{Name: "target", Usage: "upstream in any import line format, credentials in it replace the upstream ones"},
+					&cli.StringFlag{Name: "upstream-username"},
+					&cli.StringFlag{Name: "upstream-password"},
+					&cli.StringSliceFlag{Name: "tag", Usage: "replaces the tags, repeatable"},
+					cfgPathsFlag(),
+				},
+				Action: func(ctx context.Context, command *cli.Command) error {
+					repo, err := newRepository(command)
+					if err != nil {
+						log.Fatalf("Failed to create repository: %v", err)
+					}
+					defer repo.Close()
+
+					pr := router.NewProxyRouter(repo)
+					model, err := pr.FindProxy(ctx, command.String("username"))
+					if err != nil {
+						return err
+					}
+
+					proxy := &router.ProxyConfig{
+						Username:         model.Username,
+						Target:           model.Target,
+						UpstreamUsername: model.UpstreamUsername,
+						UpstreamPassword: model.UpstreamPassword,
+						Tags:             model.Tags,
+					}
+					if command.IsSet("password") {
+						proxy.Password = command.String("password")
+					}
+					if command.IsSet("target") {
+						target, upstreamUser, upstreamPass, err := importer.ParseLine(command.String("target"))
+						if err != nil {
+							return fmt.Errorf("invalid --target: %w", err)
+						}
+						proxy.Target = target
+						if upstreamUser != "" {
+							proxy.UpstreamUsername, proxy.UpstreamPassword = upstreamUser, upstreamPass
+						}
+					}
+					if command.IsSet("upstream-username") {
+						proxy.UpstreamUsername = command.String("upstream-username")
+					}
+					if command.IsSet("upstream-password") {
+						proxy.UpstreamPassword = command.String("upstream-password")
+					}
+					if command.IsSet("tag") {
+						proxy.Tags = command.StringSlice("tag")
+					}
+
+					if err := pr.UpdateProxy(ctx, proxy); err != nil {
+						return fmt.Errorf("failed to update proxy: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "remove",
+				Description: "Remove proxies, also from the pools they are in",
+				Flags:       []cli.Flag{&cli.StringSliceFlag{Name: "username", Required: true, Usage: "repeatable"}, cfgPathsFlag()},
+				Action: func(ctx context.Context, command *cli.Command) error {
+					repo, err := newRepository(command)
+					if err != nil {
+						log.Fatalf("Failed to create repository: %v", err)
+					}
+					defer repo.Close()
+
+					pr := router.NewProxyRouter(repo)
+					for _, username := range command.StringSlice("username") {
+						if err := pr.RemoveProxy(ctx, username); err != nil {
+							return fmt.Errorf("failed to remove %s: %w", username, err)
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "show",
+				Description: "Show a proxy with its check state and exit location",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "username", Required: true},
+					outputFlag(),
+					cfgPathsFlag(),
+				},
+				Action: func(ctx context.Context, command *cli.Command) error {
+					conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					repo, err := newRepository(command)
+					if err != nil {
+						log.Fatalf("Failed to create repository: %v", err)
+					}
+					defer repo.Close()
+
+					model, err := router.NewProxyRouter(repo).FindProxy(ctx, command.String("username"))
+					if err != nil {
+						return err
+					}
+
+					proxy := newProxyOutput(conf, model)
+					if command.String("output") == outputJSON {
+						encoder := json.NewEncoder(os.Stdout)
+						encoder.SetIndent("", "  ")
+						return encoder.Encode(proxy)
+					}
+
+					header := []string{"field", "value"}
+					fields := [][]string{
+						{"username", proxy.Username},
+						{"target", proxy.Target},
+						{"upstream_username", proxy.UpstreamUsername},
+						{"status", proxy.Status},
+						{"exit_ip", proxy.ExitIP},
+						{"country", proxy.Country},
+						{"asn", strconv.FormatUint(uint64(proxy.ASN), 10)},
+						{"anonymity", proxy.Anonymity},
+						{"tags", strings.Join(proxy.Tags, ",")},
+						{"failed_checks", strconv.Itoa(proxy.FailedChecks)},
+						{"last_check_at", proxy.LastCheckAt},
+						{"url", proxy.URL},
+					}
+					return printList(os.Stdout, command.String("output"), header, fields, func(field []string) []string { return field })
+				},
+			},
+			proxyStatusCommand("enable", "Put proxies back into service", repository.StatusActive),
+			proxyStatusCommand("disable", "Take proxies out of service until they are enabled", repository.StatusDisabled),
+		},
+	}
+}
+
+func proxyStatusCommand(name, description, status string) *cli.Command {
+	return &cli.Command{
+		Name:        name,
+		Description: description,
+		Flags:       []cli.Flag{&cli.StringSliceFlag{Name: "username", Required: true, Usage: "repeatable"}, cfgPathsFlag()},
+		Action: func(ctx context.Context, command *cli.Command) error {
+			repo, err := newRepository(command)
+			if err != nil {
+				log.Fatalf("Failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			pr := router.NewProxyRouter(repo)
+			for _, username := range command.StringSlice("username") {
+				if err := pr.SetStatus(ctx, username, status); err != nil {
+					return fmt.Errorf("failed to %s %s: %w", name, username, err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+type credentialsOutput struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	URL      string `json:"url"`
+}
+
+func rotateCredentialsCommand() *cli.Command {
+	return &cli.Command{
+		Name:        "rotate-credentials",
+		Description: "Generate new passwords for proxy and pool users and print them",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{Name: "username", Usage: "rotate this user, repeatable"},
+			&cli.BoolFlag{Name: "all", Usage: "rotate every proxy and pool user"},
+			outputFlag(),
+			cfgPathsFlag(),
+		},
+		Action: func(ctx context.Context, command *cli.Command) error {
+			usernames := command.StringSlice("username")
+			if (len(usernames) > 0) == command.Bool("all") {
+				return fmt.Errorf("use either --username or --all")
+			}
+
+			conf, err := loadConfig(command.Args().Slice(), command.StringSlice("configs"))
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			repo, err := newRepository(command)
+			if err != nil {
+				log.Fatalf("Failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			pr := router.NewProxyRouter(repo)
+			if command.Bool("all") {
+				proxies, err := pr.GetAllProxies()
+				if err != nil {
+					return err
+				}
+				for _, proxy := range proxies {
+					usernames = append(usernames, proxy.Username)
+				}
+				for _, pool := range pr.GetAllPools() {
+					usernames = append(usernames, pool.Username)
+				}
+				slices.Sort(usernames)
+			}
+
+			var rotated []credentialsOutput
+			for _, username := range usernames {
+				password := utils.RandomString(12)
+				if err := pr.SetPassword(ctx, username, password); err != nil {
+					// Print what was rotated already, those passwords are gone.
+					_ = printList(os.Stdout, command.String("output"), credentialsHeader, rotated, credentialsOutput.row)
+					return fmt.Errorf("failed to rotate %s: %w", username, err)
+				}
+				rotated = append(rotated, credentialsOutput{Username: username, Password: password, URL: proxyURL(conf, username, password)})
+			}
+
+			return printList(os.Stdout, command.String("output"), credentialsHeader, rotated, credentialsOutput.row)
+		},
+	}
+}
+
+var credentialsHeader = []string{"username", "password", "url"}
+
+func (c credentialsOutput) row() []string {
+	return []string{c.Username, c.Password, c.URL}
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/router"
+	"github.com/stickpro/p-router/internal/service/checker"
+	"github.com/stickpro/p-router/pkg/logger"
+)
+
+const maxBodySize = 1 << 20
+
+// Server is the admin REST API. All mutations go through router.ProxyRouter
+// so the in-memory cache used by the proxy listeners stays consistent.
+type Server struct {
+	token   string
+	router  *router.ProxyRouter
+	checker checker.ICheckerService
+	l       logger.Logger
+	server  *http.Server
+
+	baseCtx  context.Context
+	cancel   context.CancelFunc
+	checking atomic.Bool
+}
+
+func NewServer(addr, token string, r *router.ProxyRouter, chkr checker.ICheckerService, l logger.Logger) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		token:   token,
+		router:  r,
+		checker: chkr,
+		l:       l,
+		baseCtx: ctx,
+		cancel:  cancel,
+	}
+
+	s.server = &http.Server{
+		Addr:         addr,
+		Handler:      s.Handler(),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	return s
+}
+
+func (s *Server) Start() error {
+	if s.token == "" {
+		return errors.New("admin token is not configured")
+	}
+	return s.server.ListenAndServe()
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	s.cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// Handler returns the API routes wrapped in token authentication.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/v1/proxies", s.listProxies)
+	mux.HandleFunc("POST /api/v1/proxies", s.createProxy)
+	mux.HandleFunc("GET /api/v1/proxies/{username}", s.getProxy)
+	mux.HandleFunc("PUT /api/v1/proxies/{username}", s.updateProxy)
+	mux.HandleFunc("DELETE /api/v1/proxies/{username}", s.deleteProxy)
+	mux.HandleFunc("POST /api/v1/checks", s.runCheck)
+
+	return s.authenticate(mux)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type proxyResponse struct {
+	ID               int64    `json:"id"`
+	Username         string   `json:"username"`
+	Target           string   `json:"target"`
+	UpstreamUsername string   `json:"upstream_username,omitempty"`
+	Status           string   `json:"status"`
+	ExitIP           string   `json:"exit_ip,omitempty"`
+	Country          string   `json:"country,omitempty"`
+	ASN              uint     `json:"asn,omitempty"`
+	ASOrg            string   `json:"as_org,omitempty"`
+	Anonymity        string   `json:"anonymity,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	FailedChecks     int      `json:"failed_checks"`
+	LastCheckAt      string   `json:"last_check_at,omitempty"`
+	CreatedAt        string   `json:"created_at,omitempty"`
+}
+
+func newProxyResponse(model *repository.ProxyModel) proxyResponse {
+	return proxyResponse{
+		ID:               model.ID,
+		Username:         model.Username,
+		Target:           model.Target,
+		UpstreamUsername: model.UpstreamUsername,
+		Status:           model.Status,
+		ExitIP:           model.Exit.IP,
+		Country:          model.Exit.Country,
+		ASN:              model.Exit.ASN,
+		ASOrg:            model.Exit.ASOrg,
+		Anonymity:        model.Exit.Anonymity,
+		Tags:             model.Tags,
+		FailedChecks:     model.FailedChecks,
+		LastCheckAt:      model.LastCheckAt,
+		CreatedAt:        model.CreatedAt,
+	}
+}
+
+type proxyRequest struct {
+	Username         string   `json:"username"`
+	Password         string   `json:"password"`
+	Target           string   `json:"target"`
+	UpstreamUsername string   `json:"upstream_username"`
+	UpstreamPassword string   `json:"upstream_password"`
+	Tags             []string `json:"tags"`
+}
+
+func (s *Server) listProxies(w http.ResponseWriter, r *http.Request) {
+	models, err := s.router.FindProxies(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result := make([]proxyResponse, 0, len(models))
+	for _, model := range models {
+		result = append(result, newProxyResponse(model))
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) getProxy(w http.ResponseWriter, r *http.Request) {
+	model, err := s.router.FindProxy(r.Context(), r.PathValue("username"))
+	if err != nil {
+		writeRouterError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newProxyResponse(model))
+}
+
+func (s *Server) createProxy(w http.ResponseWriter, r *http.Request) {
+	var req proxyRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Username == "" || req.Password == "" || req.Target == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username, password and target are required"))
+		return
+	}
+
+	err := s.router.AddProxy(r.Context(), &router.ProxyConfig{
+		Username:         req.Username,
+		Password:         req.Password,
+		Target:           req.Target,
+		UpstreamUsername: req.UpstreamUsername,
+		UpstreamPassword: req.UpstreamPassword,
+		Tags:             req.Tags,
+	})
+	if err != nil {
+		writeRouterError(w, err)
+		return
+	}
+
+	s.respondWithProxy(w, r, http.StatusCreated, req.Username)
+}
+
+// updateProxy replaces the target of a proxy. Fields left out of the body
+// keep their current values, and so does an empty password.
+func (s *Server) updateProxy(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	current, err := s.router.FindProxy(r.Context(), username)
+	if err != nil {
+		writeRouterError(w, err)
+		return
+	}
+
+	// Decoding over the current values keeps those the body leaves out.
+	req := proxyRequest{
+		UpstreamUsername: current.UpstreamUsername,
+		UpstreamPassword: current.UpstreamPassword,
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Target == "" {
+		writeError(w, http.StatusBadRequest, errors.New("target is required"))
+		return
+	}
+	if req.Tags == nil {
+		req.Tags = current.Tags
+	}
+	// An empty password is passed on as is, UpdateProxy keeps the stored hash
+	// for it rather than hashing the hash.
+
+	err = s.router.UpdateProxy(r.Context(), &router.ProxyConfig{
+		Username:         username,
+		Password:         req.Password,
+		Target:           req.Target,
+		UpstreamUsername: req.UpstreamUsername,
+		UpstreamPassword: req.UpstreamPassword,
+		Tags:             req.Tags,
+	})
+	if err != nil {
+		writeRouterError(w, err)
+		return
+	}
+
+	s.respondWithProxy(w, r, http.StatusOK, username)
+}
+
+func (s *Server) deleteProxy(w http.ResponseWriter, r *http.Request) {
+	if err := s.router.RemoveProxy(r.Context(), r.PathValue("username")); err != nil {
+		writeRouterError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runCheck starts a health check of all proxies in the background.
+func (s *Server) runCheck(w http.ResponseWriter, _ *http.Request) {
+	if !s.checking.CompareAndSwap(false, true) {
+		writeError(w, http.StatusConflict, errors.New("health check already running"))
+		return
+	}
+
+	go func() {
+		defer s.checking.Store(false)
+		if err := s.checker.Check(s.baseCtx); err != nil {
+			s.l.Error("admin triggered proxy check failed", err)
+		}
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+}
+
+func (s *Server) respondWithProxy(w http.ResponseWriter, r *http.Request, status int, username string) {
+	model, err := s.router.FindProxy(r.Context(), username)
+	if err != nil {
+		writeRouterError(w, err)
+		return
+	}
+
+	writeJSON(w, status, newProxyResponse(model))
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func writeRouterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, router.ErrProxyNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, router.ErrProxyExists), errors.Is(err, repository.ErrDuplicate):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, router.ErrInvalidTarget), errors.Is(err, router.ErrInvalidTag):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
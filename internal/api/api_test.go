@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/router"
+	"github.com/stickpro/p-router/pkg/logger"
+)
+
+const testToken = "secret"
+
+type stubChecker struct {
+	calls chan struct{}
+}
+
+func (c *stubChecker) Check(context.Context) error {
+	c.calls <- struct{}{}
+	return nil
+}
+
+func (c *stubChecker) StartPeriodicCheck(context.Context, time.Duration) {}
+
+func newTestServer(t *testing.T) (*httptest.Server, *router.ProxyRouter, *stubChecker) {
+	t.Helper()
+
+	repo, err := repository.NewSQLiteRepository(filepath.Join(t.TempDir(), "proxies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	pr := router.NewProxyRouter(repo)
+	chkr := &stubChecker{calls: make(chan struct{}, 1)}
+	srv := NewServer("", testToken, pr, chkr, logger.New())
+
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+
+	return ts, pr, chkr
+}
+
+func doRequest(t *testing.T, method, url, token, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func TestAuthRequired(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+
+	if resp := doRequest(t, http.MethodGet, ts.URL+"/api/v1/proxies", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodGet, ts.URL+"/api/v1/proxies", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with wrong token, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyCRUD(t *testing.T) {
+	ts, pr, _ := newTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, ts.URL+"/api/v1/proxies", testToken,
+		`{"username":"user","password":"pass","target":"127.0.0.1:3128","upstream_username":"u","upstream_password":"p"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", resp.StatusCode)
+	}
+	if _, ok := pr.GetProxy("user", "pass"); !ok {
+		t.Fatal("created proxy is not routable")
+	}
+
+	resp = doRequest(t, http.MethodPost, ts.URL+"/api/v1/proxies", testToken,
+		`{"username":"user","password":"pass","target":"127.0.0.1:3129"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("duplicate create: expected 409, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPost, ts.URL+"/api/v1/proxies", testToken,
+		`{"username":"other","password":"pass","target":"ftp://127.0.0.1:21"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid target: expected 400, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPut, ts.URL+"/api/v1/proxies/user", testToken,
+		`{"target":"socks5://127.0.0.1:1080"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("update: expected 200, got %d", resp.StatusCode)
+	}
+	config, ok := pr.GetProxy("user", "pass")
+	if !ok || config.Target != "socks5://127.0.0.1:1080" {
+		t.Fatalf("cache not updated: %+v", config)
+	}
+	if config.UpstreamUsername != "u" || config.UpstreamPassword != "p" {
+		t.Fatalf("update without upstream credentials cleared them: %+v", config)
+	}
+
+	resp = doRequest(t, http.MethodGet, ts.URL+"/api/v1/proxies", testToken, "")
+	var list []proxyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Username != "user" {
+		t.Fatalf("unexpected list %+v", list)
+	}
+
+	resp = doRequest(t, http.MethodDelete, ts.URL+"/api/v1/proxies/user", testToken, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+	if _, ok := pr.GetProxy("user", "pass"); ok {
+		t.Fatal("deleted proxy is still routable")
+	}
+
+	resp = doRequest(t, http.MethodGet, ts.URL+"/api/v1/proxies/user", testToken, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get deleted: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	ts, _, chkr := newTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, ts.URL+"/api/v1/checks", testToken, "")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	<-chkr.calls
+}
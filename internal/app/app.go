@@ -4,29 +4,79 @@ import (
 	"context"
 	"errors"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"time"
 
+	"github.com/stickpro/p-router/internal/api"
 	"github.com/stickpro/p-router/internal/config"
+	"github.com/stickpro/p-router/internal/metrics"
 	"github.com/stickpro/p-router/internal/repository"
 	"github.com/stickpro/p-router/internal/router"
 	"github.com/stickpro/p-router/internal/server"
 	"github.com/stickpro/p-router/internal/service/checker"
 	"github.com/stickpro/p-router/pkg/logger"
+	appsignal "github.com/stickpro/p-router/pkg/util/signal"
 )
 
 func Run(ctx context.Context, conf *config.Config, l logger.Logger) {
 	l.Info("starting app")
 
-	repo, err := repository.NewSQLiteRepository("proxies.db")
+	repo, err := repository.New(conf.Storage.Driver, conf.Storage.DSN)
 	if err != nil {
 		log.Fatalf("Failed to create repository: %v", err)
 	}
 	defer repo.Close()
 
-	r := router.NewProxyRouter(repo)
+	r := router.NewProxyRouter(repo,
+		router.WithSessionTTL(conf.Router.SessionTTL),
+		router.WithBreaker(conf.Breaker.Threshold, conf.Breaker.Cooldown),
+	)
 
-	srv := server.NewServer(":"+conf.HTTP.Port, r)
+	failover := server.WithFailover(conf.Failover.MaxAttempts, conf.Failover.Budget)
+	limiter := server.WithLimiter(server.NewLimiter(r, repository.Limits{
+		RateLimit: conf.Limits.RateLimit,
+		RateBurst: conf.Limits.RateBurst,
+		MaxConns:  conf.Limits.MaxConns,
+	}))
+
+	meter, err := server.NewMeter(ctx, r, repo)
+	if err != nil {
+		log.Fatalf("Failed to load usage: %v", err)
+	}
+	meterCtx, stopMeter := context.WithCancel(context.Background())
+	meterDone := make(chan error, 1)
+	go func() {
+		meterDone <- meter.Run(meterCtx, conf.Usage.FlushInterval)
+	}()
+	metered := server.WithMeter(meter)
+
+	var m *metrics.Metrics
+	var metricsSrv *http.Server
+	if conf.Metrics.Enabled {
+		m = metrics.New(r.Size)
+
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", m.Handler())
+		metricsSrv = &http.Server{
+			Addr:              net.JoinHostPort(conf.Metrics.Host, conf.Metrics.Port),
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		l.Infof("Metrics listener started on %s", metricsSrv.Addr)
+
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				l.Error("error occurred while running metrics server", err)
+			}
+		}()
+	}
+	instrumented := server.WithMetrics(m)
+
+	srv := server.NewServer(":"+conf.HTTP.Port, r, failover, limiter, metered, instrumented)
 
 	l.Infof("Proxy router started on :%s", conf.HTTP.Port)
 	l.Infow("Available proxies:")
@@ -37,10 +87,59 @@ func Run(ctx context.Context, conf *config.Config, l logger.Logger) {
 		}
 	}()
 
-	chkr := checker.New(conf, l, repo)
+	var socksSrv *server.Socks5Server
+	if conf.Socks5.Enabled {
+		socksSrv = server.NewSocks5Server(net.JoinHostPort(conf.Socks5.Host, conf.Socks5.Port), r, conf.Socks5.UDPEnabled, failover, limiter, metered, instrumented)
+
+		l.Infof("SOCKS5 listener started on %s", net.JoinHostPort(conf.Socks5.Host, conf.Socks5.Port))
+
+		go func() {
+			if err := socksSrv.Start(); err != nil && !errors.Is(err, server.ErrSocks5ServerClosed) {
+				l.Error("error occurred while running socks5 server", err)
+			}
+		}()
+	}
+
+	reload := func() {
+		if err := r.Reload(ctx); err != nil {
+			l.Error("failed to reload proxies", err)
+		}
+	}
+
+	geoip, err := checker.OpenGeoIP(conf.Checker.GeoIPCountryDB, conf.Checker.GeoIPASNDB)
+	if err != nil {
+		log.Fatalf("Failed to open GeoIP databases: %v", err)
+	}
+	defer geoip.Close()
+
+	chkr := checker.New(conf, l, repo,
+		checker.WithGeoIP(geoip),
+		checker.WithObserver(func(result checker.CheckResult) {
+			r.SetHealth(result.Username, result.Success, result.Latency)
+			m.Check(result.Username, result.Success, result.Latency)
+		}),
+		checker.WithDeleteObserver(m.Deleted),
+		checker.WithDeleteObserver(func(string) { reload() }),
+		checker.WithStatusObserver(func(string, string) { reload() }),
+	)
 
 	go chkr.StartPeriodicCheck(ctx, conf.Checker.Interval)
 
+	go watchReload(ctx, r, conf.Router.ReloadInterval, l)
+
+	var adminSrv *api.Server
+	if conf.Admin.Enabled {
+		adminSrv = api.NewServer(net.JoinHostPort(conf.Admin.Host, conf.Admin.Port), conf.Admin.Token, r, chkr, l)
+
+		l.Infof("Admin API started on %s", net.JoinHostPort(conf.Admin.Host, conf.Admin.Port))
+
+		go func() {
+			if err := adminSrv.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				l.Error("error occurred while running admin server", err)
+			}
+		}()
+	}
+
 	<-ctx.Done()
 
 	l.Info("Shutting down server...")
@@ -52,5 +151,56 @@ func Run(ctx context.Context, conf *config.Config, l logger.Logger) {
 		l.Error("Server forced to shutdown", err)
 	}
 
+	if socksSrv != nil {
+		if err := socksSrv.Stop(shutdownCtx); err != nil {
+			l.Error("SOCKS5 server forced to shutdown", err)
+		}
+	}
+
+	if adminSrv != nil {
+		if err := adminSrv.Stop(shutdownCtx); err != nil {
+			l.Error("Admin server forced to shutdown", err)
+		}
+	}
+
+	if metricsSrv != nil {
+		if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+			l.Error("Metrics server forced to shutdown", err)
+		}
+	}
+
+	stopMeter()
+	if err := <-meterDone; err != nil {
+		l.Error("failed to flush usage", err)
+	}
+
 	l.Info("Server stopped")
 }
+
+// watchReload reloads the router cache every interval and on SIGHUP until ctx is done.
+func watchReload(ctx context.Context, r *router.ProxyRouter, interval time.Duration, l logger.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, appsignal.Reload()...)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			l.Info("reloading proxies")
+		case <-tick:
+		}
+
+		if err := r.Reload(ctx); err != nil {
+			l.Error("failed to reload proxies", err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package metrics
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "p_router"
+
+// Metrics holds the Prometheus collectors of the router. A nil *Metrics
+// records nothing, so callers need no checks when metrics are disabled.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	activeTunnels *prometheus.GaugeVec
+	requests      *prometheus.CounterVec
+	dialDuration  *prometheus.HistogramVec
+	authFailures  *prometheus.CounterVec
+	bytes         *prometheus.CounterVec
+	checks        *prometheus.CounterVec
+	checkLatency  *prometheus.GaugeVec
+	deletions     prometheus.Counter
+}
+
+// CacheSize reports the number of cached proxies and pools.
+type CacheSize func() (proxies, pools int)
+
+func New(cacheSize CacheSize) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		activeTunnels: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_tunnels",
+			Help:      "Open client tunnels.",
+		}, []string{"protocol"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Proxy requests by method and response status.",
+		}, []string{"method", "status"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_dial_duration_seconds",
+			Help:      "Time taken to connect through an upstream proxy.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"upstream", "result"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_failures_total",
+			Help:      "Rejected client logins.",
+		}, []string{"protocol"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transferred_bytes_total",
+			Help:      "Bytes moved through upstreams, up is sent by clients.",
+		}, []string{"direction"}),
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "checks_total",
+			Help:      "Health checks by result.",
+		}, []string{"result"}),
+		checkLatency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "check_latency_seconds",
+			Help:      "Latency of the last successful health check per proxy.",
+		}, []string{"proxy"}),
+		deletions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "check_deletions_total",
+			Help:      "Proxies deleted after too many failed health checks.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.activeTunnels,
+		m.requests,
+		m.dialDuration,
+		m.authFailures,
+		m.bytes,
+		m.checks,
+		m.checkLatency,
+		m.deletions,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	if cacheSize != nil {
+		m.registry.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "cached_proxies",
+				Help:      "Proxies in the router cache.",
+			}, func() float64 {
+				proxies, _ := cacheSize()
+				return float64(proxies)
+			}),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "cached_pools",
+				Help:      "Pools in the router cache.",
+			}, func() float64 {
+				_, pools := cacheSize()
+				return float64(pools)
+			}),
+		)
+	}
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// TunnelOpened counts an open tunnel until the returned function is called.
+func (m *Metrics) TunnelOpened(protocol string) func() {
+	if m == nil {
+		return func() {}
+	}
+
+	gauge := m.activeTunnels.WithLabelValues(protocol)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// Request counts a proxied request. Methods come from clients, so methods
+// other than the standard ones share the label "other".
+func (m *Metrics) Request(method string, status int) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(methodLabel(method), strconv.Itoa(status)).Inc()
+}
+
+var methods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+func methodLabel(method string) string {
+	if slices.Contains(methods, method) {
+		return method
+	}
+	return "other"
+}
+
+func (m *Metrics) Dial(upstream string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.dialDuration.WithLabelValues(upstream, result).Observe(d.Seconds())
+}
+
+func (m *Metrics) AuthFailure(protocol string) {
+	if m == nil {
+		return
+	}
+	m.authFailures.WithLabelValues(protocol).Inc()
+}
+
+func (m *Metrics) Transferred(up, down int64) {
+	if m == nil {
+		return
+	}
+	if up > 0 {
+		m.bytes.WithLabelValues("up").Add(float64(up))
+	}
+	if down > 0 {
+		m.bytes.WithLabelValues("down").Add(float64(down))
+	}
+}
+
+// Check records a health check result of the proxy owned by username.
+func (m *Metrics) Check(username string, success bool, latency time.Duration) {
+	if m == nil {
+		return
+	}
+
+	if !success {
+		m.checks.WithLabelValues("failure").Inc()
+		return
+	}
+	m.checks.WithLabelValues("success").Inc()
+	m.checkLatency.WithLabelValues(username).Set(latency.Seconds())
+}
+
+// Deleted records a proxy deleted by the checker.
+func (m *Metrics) Deleted(username string) {
+	if m == nil {
+		return
+	}
+	m.deletions.Inc()
+	m.checkLatency.DeleteLabelValues(username)
+}
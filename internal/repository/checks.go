@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const checkTimeLayout = time.DateTime
+
+// CheckModel is one health check of a proxy. ErrorClass names the step that
+// failed and is empty for successful checks.
+type CheckModel struct {
+	ID         int64
+	Username   string
+	CheckedAt  time.Time
+	Success    bool
+	Latency    time.Duration
+	StatusCode int
+	ErrorClass string
+}
+
+// CheckStats summarizes the check history of a proxy. Latency percentiles
+// only cover successful checks.
+type CheckStats struct {
+	Username  string
+	Checks    int
+	Successes int
+	P50       time.Duration
+	P95       time.Duration
+}
+
+// Uptime returns the share of successful checks in percent.
+func (s *CheckStats) Uptime() float64 {
+	if s.Checks == 0 {
+		return 0
+	}
+	return float64(s.Successes) * 100 / float64(s.Checks)
+}
+
+func (r *SQLiteRepository) AddCheck(ctx context.Context, model *CheckModel) error {
+	if _, err := r.q.ExecContext(ctx,
+		"INSERT INTO proxy_checks (username, checked_at, success, latency_ms, status_code, error_class) VALUES (?, ?, ?, ?, ?, ?)",
+		model.Username, model.CheckedAt.UTC().Format(checkTimeLayout), model.Success, model.Latency.Milliseconds(), model.StatusCode, model.ErrorClass,
+	); err != nil {
+		return fmt.Errorf("failed to insert check: %w", err)
+	}
+	return nil
+}
+
+// FindChecks returns the checks made since the given time, oldest first.
+// An empty username returns the checks of all proxies.
+func (r *SQLiteRepository) FindChecks(ctx context.Context, username string, since time.Time) ([]*CheckModel, error) {
+	rows, err := r.q.QueryContext(ctx,
+		`SELECT id, username, checked_at, success, latency_ms, status_code, error_class FROM proxy_checks
+		WHERE checked_at >= ? AND (? = '' OR username = ?) ORDER BY checked_at, id`,
+		since.UTC().Format(checkTimeLayout), username, username,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query checks: %w", err)
+	}
+	defer rows.Close()
+
+	var models []*CheckModel
+	for rows.Next() {
+		var (
+			model     CheckModel
+			latencyMs int64
+		)
+		if err := rows.Scan(&model.ID, &model.Username, &model.CheckedAt, &model.Success, &latencyMs, &model.StatusCode, &model.ErrorClass); err != nil {
+			return nil, fmt.Errorf("failed to scan check: %w", err)
+		}
+		model.Latency = time.Duration(latencyMs) * time.Millisecond
+		models = append(models, &model)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return models, nil
+}
+
+// PruneChecks deletes the checks made before the given time and returns how many were deleted.
+func (r *SQLiteRepository) PruneChecks(ctx context.Context, before time.Time) (int64, error) {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM proxy_checks WHERE checked_at < ?", before.UTC().Format(checkTimeLayout))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune checks: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return rowsAffected, nil
+}
+
+// SummarizeChecks computes the stats of each proxy in checks, ordered by username.
+func SummarizeChecks(checks []*CheckModel) []*CheckStats {
+	byUsername := make(map[string]*CheckStats)
+	latencies := make(map[string][]time.Duration)
+	for _, check := range checks {
+		stats, exists := byUsername[check.Username]
+		if !exists {
+			stats = &CheckStats{Username: check.Username}
+			byUsername[check.Username] = stats
+		}
+		stats.Checks++
+		if check.Success {
+			stats.Successes++
+			latencies[check.Username] = append(latencies[check.Username], check.Latency)
+		}
+	}
+
+	result := make([]*CheckStats, 0, len(byUsername))
+	for username, stats := range byUsername {
+		values := latencies[username]
+		slices.Sort(values)
+		stats.P50 = percentile(values, 50)
+		stats.P95 = percentile(values, 95)
+		result = append(result, stats)
+	}
+
+	slices.SortFunc(result, func(a, b *CheckStats) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+
+	return result
+}
+
+// percentile returns the nearest-rank percentile p of sorted values.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
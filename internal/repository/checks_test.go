@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckHistory(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "proxies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	now := time.Now()
+	checks := []*CheckModel{
+		{Username: "a", CheckedAt: now.Add(-48 * time.Hour), Success: true, Latency: time.Second},
+		{Username: "a", CheckedAt: now.Add(-3 * time.Minute), Success: true, Latency: 100 * time.Millisecond, StatusCode: 200},
+		{Username: "a", CheckedAt: now.Add(-2 * time.Minute), Success: true, Latency: 300 * time.Millisecond, StatusCode: 200},
+		{Username: "a", CheckedAt: now.Add(-time.Minute), Success: false, ErrorClass: "connect"},
+		{Username: "b", CheckedAt: now.Add(-time.Minute), Success: true, Latency: 200 * time.Millisecond, StatusCode: 204},
+	}
+	for _, check := range checks {
+		if err := repo.AddCheck(ctx, check); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := repo.PruneChecks(ctx, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Fatalf("expected 1 pruned check, got %d", pruned)
+	}
+
+	found, err := repo.FindChecks(ctx, "a", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 || found[2].ErrorClass != "connect" || found[0].StatusCode != 200 {
+		t.Fatalf("unexpected checks: %+v", found)
+	}
+
+	all, err := repo.FindChecks(ctx, "", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := SummarizeChecks(all)
+	if len(stats) != 2 || stats[0].Username != "a" {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats[0].Checks != 3 || stats[0].Successes != 2 || stats[0].P50 != 100*time.Millisecond || stats[0].P95 != 300*time.Millisecond {
+		t.Fatalf("unexpected stats for a: %+v", stats[0])
+	}
+	if uptime := stats[0].Uptime(); uptime < 66 || uptime > 67 {
+		t.Fatalf("unexpected uptime %f", uptime)
+	}
+}
@@ -0,0 +1,438 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestConformance runs the same checks against every backend. PostgreSQL is
+// only tested when TEST_POSTGRES_DSN points to a database the tests may wipe.
+func TestConformance(t *testing.T) {
+	backends := map[string]func(t *testing.T) IProxyRepository{
+		DriverSQLite: func(t *testing.T) IProxyRepository {
+			repo, err := New(DriverSQLite, filepath.Join(t.TempDir(), "proxies.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return repo
+		},
+		DriverMemory: func(t *testing.T) IProxyRepository {
+			repo, err := New(DriverMemory, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return repo
+		},
+		DriverPostgres: func(t *testing.T) IProxyRepository {
+			dsn := os.Getenv("TEST_POSTGRES_DSN")
+			if dsn == "" {
+				t.Skip("TEST_POSTGRES_DSN is not set")
+			}
+			db, err := sql.Open("postgres", dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if _, err := db.Exec("DROP TABLE IF EXISTS proxies, pools, pool_members, usage, proxy_checks, schema_migrations"); err != nil {
+				t.Fatal(err)
+			}
+
+			repo, err := New(DriverPostgres, dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return repo
+		},
+	}
+
+	tests := map[string]func(t *testing.T, repo IProxyRepository){
+		"proxies": testProxies,
+		"pools":   testPools,
+		"usage":   testUsage,
+		"checks":  testChecks,
+		"tx":      testTransactions,
+	}
+
+	for _, driver := range Drivers {
+		t.Run(driver, func(t *testing.T) {
+			for name, test := range tests {
+				t.Run(name, func(t *testing.T) {
+					repo := backends[driver](t)
+					t.Cleanup(func() { repo.Close() })
+					test(t, repo)
+				})
+			}
+		})
+	}
+}
+
+func mustHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func testProxies(t *testing.T, repo IProxyRepository) {
+	ctx := context.Background()
+	limits := Limits{RateLimit: 1.5, RateBurst: 2, MaxConns: 3, DailyQuota: 4, MonthlyQuota: 5}
+	created, err := repo.Create(ctx, &ProxyModel{Username: "a", Password: "secret", Target: "10.0.0.1:3128", UpstreamUsername: "u", UpstreamPassword: "p", Limits: limits, Tags: []string{"de", "mobile"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == 0 || created.Status != StatusActive || !VerifyPassword(created.Password, "secret") {
+		t.Fatalf("unexpected created proxy: %+v", created)
+	}
+	if _, err := repo.Create(ctx, &ProxyModel{Username: "b", Password: "x", Target: "10.0.0.2:3128"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.Create(ctx, &ProxyModel{Username: "a", Password: "x", Target: "10.0.0.3:3128"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate for a taken username, got %v", err)
+	}
+	if _, err := repo.Create(ctx, &ProxyModel{Username: "c", Password: "x", Target: "10.0.0.1:3128"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate for a taken target, got %v", err)
+	}
+
+	found, err := repo.FindByUsername(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Target != "10.0.0.1:3128" || found.UpstreamUsername != "u" || found.UpstreamPassword != "p" || found.Limits != limits ||
+		!reflect.DeepEqual(found.Tags, []string{"de", "mobile"}) || found.CreatedAt == "" || found.LastCheckAt != "" {
+		t.Fatalf("unexpected proxy: %+v", found)
+	}
+	if missing, err := repo.FindByUsername(ctx, "missing"); missing != nil || err != nil {
+		t.Fatalf("expected no proxy and no error, got %+v, %v", missing, err)
+	}
+
+	found.Target, found.Password, found.Tags = "10.0.0.3:3128", "new", nil
+	if err := repo.Update(ctx, found); !errors.Is(err, ErrNotHashed) {
+		t.Fatalf("expected ErrNotHashed for a plaintext password, got %v", err)
+	}
+	if err := repo.SetPassword(ctx, "a", "rotated"); !errors.Is(err, ErrNotHashed) {
+		t.Fatalf("expected ErrNotHashed for a plaintext password, got %v", err)
+	}
+	found.Password = mustHash(t, "new")
+	if err := repo.Update(ctx, found); err != nil {
+		t.Fatal(err)
+	}
+	hash := found.Password
+	found.Password = ""
+	if err := repo.Update(ctx, found); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := repo.FindByUsername(ctx, "a"); err != nil || stored.Password != hash {
+		t.Fatalf("expected an empty password to keep the stored one, got %+v, %v", stored, err)
+	}
+	found.Target = "10.0.0.2:3128"
+	if err := repo.Update(ctx, found); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate for a taken target, got %v", err)
+	}
+	if err := repo.Update(ctx, &ProxyModel{Username: "missing", Password: mustHash(t, "x"), Target: "10.0.0.9:3128"}); err == nil {
+		t.Fatal("expected an error updating a missing proxy")
+	}
+
+	for _, err := range []error{
+		repo.SetStatus(ctx, "a", StatusDegraded),
+		repo.SetExitInfo(ctx, "a", ExitInfo{IP: "1.2.3.4", Country: "DE", ASN: 3320, ASOrg: "DTAG", Anonymity: AnonymityElite}),
+		repo.SetTags(ctx, "a", []string{"fast"}),
+		repo.SetLimits(ctx, "a", Limits{MaxConns: 7}),
+		repo.SetPassword(ctx, "a", mustHash(t, "rotated")),
+		repo.IncrementFailedChecks(ctx, "a"),
+		repo.IncrementFailedChecks(ctx, "a"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, err := range map[string]error{
+		"SetStatus":             repo.SetStatus(ctx, "missing", StatusActive),
+		"SetExitInfo":           repo.SetExitInfo(ctx, "missing", ExitInfo{}),
+		"SetTags":               repo.SetTags(ctx, "missing", nil),
+		"SetLimits":             repo.SetLimits(ctx, "missing", Limits{}),
+		"SetPassword":           repo.SetPassword(ctx, "missing", mustHash(t, "x")),
+		"IncrementFailedChecks": repo.IncrementFailedChecks(ctx, "missing"),
+		"ResetFailedChecks":     repo.ResetFailedChecks(ctx, "missing"),
+		"Delete":                repo.Delete(ctx, "missing"),
+	} {
+		if err == nil {
+			t.Fatalf("expected %s to fail for a missing proxy", name)
+		}
+	}
+
+	found, err = repo.FindByUsername(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Target != "10.0.0.3:3128" || found.Status != StatusDegraded || found.Exit.ASN != 3320 || found.Exit.Anonymity != AnonymityElite ||
+		!reflect.DeepEqual(found.Tags, []string{"fast"}) || found.Limits.MaxConns != 7 || found.FailedChecks != 2 || found.LastCheckAt == "" ||
+		!VerifyPassword(found.Password, "rotated") {
+		t.Fatalf("unexpected proxy: %+v", found)
+	}
+
+	if err := repo.ResetFailedChecks(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := repo.FindAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Username != "a" || all[0].FailedChecks != 0 {
+		t.Fatalf("unexpected proxies: %+v", all)
+	}
+}
+
+func testPools(t *testing.T, repo IProxyRepository) {
+	ctx := context.Background()
+	for _, username := range []string{"a", "b", "c"} {
+		if _, err := repo.Create(ctx, &ProxyModel{Username: username, Password: "x", Target: username + ".example.com:3128"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool, err := repo.CreatePool(ctx, &PoolModel{Name: "p", Username: "pool", Password: "secret", Strategy: "random"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.ID == 0 || !VerifyPassword(pool.Password, "secret") {
+		t.Fatalf("unexpected created pool: %+v", pool)
+	}
+	if _, err := repo.CreatePool(ctx, &PoolModel{Name: "p", Username: "other", Password: "x", Strategy: "random"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate for a taken name, got %v", err)
+	}
+	if _, err := repo.CreatePool(ctx, &PoolModel{Name: "q", Username: "pool", Password: "x", Strategy: "random"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate for a taken username, got %v", err)
+	}
+
+	for _, member := range []string{"c", "a", "b"} {
+		if err := repo.AddPoolMember(ctx, "p", member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.AddPoolMember(ctx, "p", "a"); err == nil {
+		t.Fatal("expected an error adding a member twice")
+	}
+	if err := repo.AddPoolMember(ctx, "p", "missing"); err == nil {
+		t.Fatal("expected an error adding a missing proxy")
+	}
+	if err := repo.RemovePoolMember(ctx, "p", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RemovePoolMember(ctx, "p", "b"); err == nil {
+		t.Fatal("expected an error removing a proxy that is not a member")
+	}
+	if err := repo.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	limits := Limits{RateLimit: 2, MaxConns: 9, MonthlyQuota: 1 << 40}
+	if err := repo.SetLimits(ctx, "pool", limits); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetPassword(ctx, "pool", mustHash(t, "rotated")); err != nil {
+		t.Fatal(err)
+	}
+
+	pools, err := repo.FindAllPools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 1 {
+		t.Fatalf("expected 1 pool, got %d", len(pools))
+	}
+	if got := pools[0]; got.Name != "p" || got.Username != "pool" || got.Strategy != "random" || got.Limits != limits ||
+		!VerifyPassword(got.Password, "rotated") || !reflect.DeepEqual(got.Members, []string{"c"}) || got.CreatedAt == "" {
+		t.Fatalf("unexpected pool: %+v", got)
+	}
+
+	if err := repo.DeletePool(ctx, "p"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeletePool(ctx, "p"); err == nil {
+		t.Fatal("expected an error deleting a missing pool")
+	}
+	if pools, err := repo.FindAllPools(ctx); err != nil || len(pools) != 0 {
+		t.Fatalf("expected no pools, got %+v, %v", pools, err)
+	}
+}
+
+func testUsage(t *testing.T, repo IProxyRepository) {
+	ctx := context.Background()
+	batches := [][]*UsageModel{
+		{
+			{Username: "b", Upstream: "u1", Day: "2024-01-02", BytesUp: 1, BytesDown: 2},
+			{Username: "a", Upstream: "u1", Day: "2024-01-02", BytesUp: 10, BytesDown: 20},
+			{Username: "a", Upstream: "u1", Day: "2024-01-01", BytesUp: 5, BytesDown: 5},
+		},
+		{
+			{Username: "a", Upstream: "u1", Day: "2024-01-02", BytesUp: 1, BytesDown: 1},
+		},
+	}
+	for _, batch := range batches {
+		if err := repo.AddUsage(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := repo.FindUsage(ctx, "2024-01-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*UsageModel{
+		{Username: "a", Upstream: "u1", Day: "2024-01-02", BytesUp: 11, BytesDown: 21},
+		{Username: "b", Upstream: "u1", Day: "2024-01-02", BytesUp: 1, BytesDown: 2},
+	}
+	if !reflect.DeepEqual(usage, want) {
+		t.Fatalf("got %+v, want %+v", usage, want)
+	}
+}
+
+func testChecks(t *testing.T, repo IProxyRepository) {
+	ctx := context.Background()
+	if _, err := repo.Create(ctx, &ProxyModel{Username: "a", Password: "x", Target: "10.0.0.1:3128"}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	checks := []*CheckModel{
+		{Username: "a", CheckedAt: now.Add(-48 * time.Hour), Success: true},
+		{Username: "a", CheckedAt: now.Add(-time.Minute), Success: false, ErrorClass: "connect"},
+		{Username: "b", CheckedAt: now.Add(-2 * time.Minute), Success: true, Latency: 250 * time.Millisecond, StatusCode: 204},
+		{Username: "a", CheckedAt: now.Add(-3 * time.Minute), Success: true, Latency: 100 * time.Millisecond, StatusCode: 200},
+	}
+	for _, check := range checks {
+		if err := repo.AddCheck(ctx, check); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := repo.FindChecks(ctx, "", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, check := range found {
+		order = append(order, check.Username+":"+check.ErrorClass)
+	}
+	if !reflect.DeepEqual(order, []string{"a:", "b:", "a:connect"}) {
+		t.Fatalf("unexpected checks %v", order)
+	}
+	if b := found[1]; b.Latency != 250*time.Millisecond || b.StatusCode != 204 || !b.Success || !b.CheckedAt.Equal(now.Add(-2*time.Minute)) {
+		t.Fatalf("unexpected check: %+v", b)
+	}
+
+	if found, err := repo.FindChecks(ctx, "a", now.Add(-time.Hour)); err != nil || len(found) != 2 {
+		t.Fatalf("expected 2 checks of a, got %d, %v", len(found), err)
+	}
+
+	pruned, err := repo.PruneChecks(ctx, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Fatalf("expected 1 pruned check, got %d", pruned)
+	}
+
+	if err := repo.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := repo.FindChecks(ctx, "", now.Add(-time.Hour)); err != nil || len(found) != 1 || found[0].Username != "b" {
+		t.Fatalf("expected only the checks of b left, got %+v, %v", found, err)
+	}
+}
+
+func testTransactions(t *testing.T, repo IProxyRepository) {
+	ctx := context.Background()
+	if _, err := repo.Create(ctx, &ProxyModel{Username: "a", Password: "x", Target: "10.0.0.1:3128"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreatePool(ctx, &PoolModel{Name: "p", Username: "pool", Password: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AddPoolMember(ctx, "p", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{1, 2} {
+		proxy, err := repo.RecordCheckResult(ctx, "a", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proxy.Username != "a" || proxy.Target != "10.0.0.1:3128" || proxy.FailedChecks != want || proxy.LastCheckAt == "" {
+			t.Fatalf("unexpected proxy after failed check %d: %+v", i+1, proxy)
+		}
+	}
+	if proxy, err := repo.RecordCheckResult(ctx, "a", true); err != nil || proxy.FailedChecks != 0 {
+		t.Fatalf("expected the failed checks reset, got %+v, %v", proxy, err)
+	}
+	if _, err := repo.RecordCheckResult(ctx, "missing", false); err == nil {
+		t.Fatal("expected RecordCheckResult to fail for a missing proxy")
+	}
+
+	broken := errors.New("broken")
+	err := repo.WithTx(ctx, func(tx IProxyStore) error {
+		if _, err := tx.Create(ctx, &ProxyModel{Username: "b", Password: "x", Target: "10.0.0.2:3128"}); err != nil {
+			return err
+		}
+		if _, err := tx.RecordCheckResult(ctx, "a", false); err != nil {
+			return err
+		}
+		if err := tx.Delete(ctx, "a"); err != nil {
+			return err
+		}
+		return broken
+	})
+	if !errors.Is(err, broken) {
+		t.Fatalf("expected the error of fn, got %v", err)
+	}
+
+	all, err := repo.FindAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Username != "a" || all[0].FailedChecks != 0 {
+		t.Fatalf("expected the transaction rolled back, got %+v", all)
+	}
+	pools, err := repo.FindAllPools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 1 || !reflect.DeepEqual(pools[0].Members, []string{"a"}) {
+		t.Fatalf("expected the pool membership kept, got %+v", pools)
+	}
+
+	if err := repo.WithTx(ctx, func(tx IProxyStore) error {
+		if _, err := tx.RecordCheckResult(ctx, "a", false); err != nil {
+			return err
+		}
+		return tx.SetStatus(ctx, "a", StatusQuarantined)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := repo.FindByUsername(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.FailedChecks != 1 || found.Status != StatusQuarantined {
+		t.Fatalf("expected the transaction committed, got %+v", found)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := repo.WithTx(cancelled, func(IProxyStore) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,498 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryRepository keeps everything in memory and loses it on exit. It is
+// meant for tests and throwaway routers, and behaves like the SQL backends.
+type MemoryRepository struct {
+	mu      sync.Mutex
+	proxies []*ProxyModel
+	pools   []*PoolModel
+	usage   []*UsageModel
+	checks  []*CheckModel
+	// Last IDs given out, per table like the SQL backends.
+	proxyID int64
+	poolID  int64
+	checkID int64
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{}
+}
+
+// memoryNow returns the current time in the formats SQLite returns it in.
+func memoryNow() (dateTime, rfc3339 string) {
+	now := time.Now().UTC()
+	return now.Format(time.DateTime), now.Format(time.RFC3339)
+}
+
+func (r *MemoryRepository) proxy(username string) *ProxyModel {
+	for _, model := range r.proxies {
+		if model.Username == username {
+			return model
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) pool(name string) *PoolModel {
+	for _, model := range r.pools {
+		if model.Name == name {
+			return model
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) poolByUsername(username string) *PoolModel {
+	for _, model := range r.pools {
+		if model.Username == username {
+			return model
+		}
+	}
+	return nil
+}
+
+// WithTx runs fn on a copy of the data that replaces it when fn returns nil.
+// Other calls wait until fn returns.
+func (r *MemoryRepository) WithTx(ctx context.Context, fn func(tx IProxyStore) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := r.clone()
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	r.proxies, r.pools, r.usage, r.checks = tx.proxies, tx.pools, tx.usage, tx.checks
+	r.proxyID, r.poolID, r.checkID = tx.proxyID, tx.poolID, tx.checkID
+	return nil
+}
+
+// clone returns a deep copy of the data of r, which is locked by the caller.
+func (r *MemoryRepository) clone() *MemoryRepository {
+	c := &MemoryRepository{proxyID: r.proxyID, poolID: r.poolID, checkID: r.checkID}
+	for _, model := range r.proxies {
+		c.proxies = append(c.proxies, copyProxy(model))
+	}
+	for _, model := range r.pools {
+		pool := *model
+		pool.Members = slices.Clone(model.Members)
+		c.pools = append(c.pools, &pool)
+	}
+	for _, model := range r.usage {
+		usage := *model
+		c.usage = append(c.usage, &usage)
+	}
+	for _, model := range r.checks {
+		check := *model
+		c.checks = append(c.checks, &check)
+	}
+	return c
+}
+
+// Create stores a proxy, hashing its password.
+func (r *MemoryRepository) Create(ctx context.Context, model *ProxyModel) (*ProxyModel, error) {
+	hash, err := HashPassword(model.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, other := range r.proxies {
+		if other.Username == model.Username || other.Target == model.Target {
+			return nil, fmt.Errorf("%w: username %s or target %s", ErrDuplicate, model.Username, model.Target)
+		}
+	}
+
+	r.proxyID++
+	_, createdAt := memoryNow()
+	stored := &ProxyModel{
+		ID:               r.proxyID,
+		Username:         model.Username,
+		Password:         hash,
+		Target:           model.Target,
+		UpstreamUsername: model.UpstreamUsername,
+		UpstreamPassword: model.UpstreamPassword,
+		Limits:           model.Limits,
+		Status:           StatusActive,
+		Tags:             slices.Clone(model.Tags),
+		CreatedAt:        createdAt,
+	}
+	r.proxies = append(r.proxies, stored)
+
+	created := *stored
+	created.CreatedAt = ""
+	created.Tags = model.Tags
+	return &created, nil
+}
+
+// Update changes a proxy. Its password must be hashed already, see
+// HashPassword; an empty password keeps the stored one.
+func (r *MemoryRepository) Update(ctx context.Context, model *ProxyModel) error {
+	hash := model.Password
+	if hash != "" {
+		if err := requireHash(model.Username, hash); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := r.proxy(model.Username)
+	if stored == nil {
+		return fmt.Errorf("proxy with username %s not found", model.Username)
+	}
+	for _, other := range r.proxies {
+		if other != stored && other.Target == model.Target {
+			return fmt.Errorf("%w: target %s", ErrDuplicate, model.Target)
+		}
+	}
+
+	if hash != "" {
+		stored.Password = hash
+	}
+	stored.Target = model.Target
+	stored.UpstreamUsername = model.UpstreamUsername
+	stored.UpstreamPassword = model.UpstreamPassword
+	stored.Tags = slices.Clone(model.Tags)
+	return nil
+}
+
+func (r *MemoryRepository) Delete(ctx context.Context, username string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := r.proxy(username)
+	if stored == nil {
+		return fmt.Errorf("proxy with username %s not found", username)
+	}
+
+	r.proxies = slices.DeleteFunc(r.proxies, func(model *ProxyModel) bool { return model == stored })
+	r.checks = slices.DeleteFunc(r.checks, func(check *CheckModel) bool { return check.Username == username })
+	for _, pool := range r.pools {
+		pool.Members = slices.DeleteFunc(pool.Members, func(member string) bool { return member == username })
+	}
+	return nil
+}
+
+func (r *MemoryRepository) FindByUsername(ctx context.Context, username string) (*ProxyModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := r.proxy(username)
+	if stored == nil {
+		return nil, nil
+	}
+	return copyProxy(stored), nil
+}
+
+func (r *MemoryRepository) FindAll(ctx context.Context) ([]*ProxyModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var models []*ProxyModel
+	for _, stored := range r.proxies {
+		models = append(models, copyProxy(stored))
+	}
+	return models, nil
+}
+
+func copyProxy(stored *ProxyModel) *ProxyModel {
+	model := *stored
+	model.Tags = slices.Clone(stored.Tags)
+	return &model
+}
+
+// updateProxy applies change to the proxy of username.
+func (r *MemoryRepository) updateProxy(username string, change func(model *ProxyModel)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := r.proxy(username)
+	if stored == nil {
+		return fmt.Errorf("proxy with username %s not found", username)
+	}
+	change(stored)
+	return nil
+}
+
+func (r *MemoryRepository) IncrementFailedChecks(ctx context.Context, username string) error {
+	return r.updateProxy(username, func(model *ProxyModel) {
+		model.FailedChecks++
+		model.LastCheckAt, _ = memoryNow()
+	})
+}
+
+func (r *MemoryRepository) ResetFailedChecks(ctx context.Context, username string) error {
+	return r.updateProxy(username, func(model *ProxyModel) {
+		model.FailedChecks = 0
+		model.LastCheckAt, _ = memoryNow()
+	})
+}
+
+// RecordCheckResult resets the failed checks of a proxy after a passed check
+// or counts a failed one, and returns the updated proxy.
+func (r *MemoryRepository) RecordCheckResult(ctx context.Context, username string, success bool) (*ProxyModel, error) {
+	var updated *ProxyModel
+	err := r.updateProxy(username, func(model *ProxyModel) {
+		if success {
+			model.FailedChecks = 0
+		} else {
+			model.FailedChecks++
+		}
+		model.LastCheckAt, _ = memoryNow()
+		updated = copyProxy(model)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (r *MemoryRepository) SetStatus(ctx context.Context, username, status string) error {
+	return r.updateProxy(username, func(model *ProxyModel) { model.Status = status })
+}
+
+func (r *MemoryRepository) SetExitInfo(ctx context.Context, username string, info ExitInfo) error {
+	return r.updateProxy(username, func(model *ProxyModel) { model.Exit = info })
+}
+
+func (r *MemoryRepository) SetTags(ctx context.Context, username string, tags []string) error {
+	return r.updateProxy(username, func(model *ProxyModel) { model.Tags = slices.Clone(tags) })
+}
+
+// SetLimits stores the limits of a router user, whether it is a proxy or a pool credential.
+func (r *MemoryRepository) SetLimits(ctx context.Context, username string, limits Limits) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stored := r.proxy(username); stored != nil {
+		stored.Limits = limits
+		return nil
+	}
+	if stored := r.poolByUsername(username); stored != nil {
+		stored.Limits = limits
+		return nil
+	}
+	return fmt.Errorf("user %s not found", username)
+}
+
+// SetPassword changes the password of a router user, whether it is a proxy or a pool credential.
+// The password must be hashed already, see HashPassword.
+func (r *MemoryRepository) SetPassword(ctx context.Context, username, hash string) error {
+	if err := requireHash(username, hash); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stored := r.proxy(username); stored != nil {
+		stored.Password = hash
+		return nil
+	}
+	if stored := r.poolByUsername(username); stored != nil {
+		stored.Password = hash
+		return nil
+	}
+	return fmt.Errorf("user %s not found", username)
+}
+
+// CreatePool stores a pool, hashing its password.
+func (r *MemoryRepository) CreatePool(ctx context.Context, model *PoolModel) (*PoolModel, error) {
+	hash, err := HashPassword(model.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, other := range r.pools {
+		if other.Name == model.Name || other.Username == model.Username {
+			return nil, fmt.Errorf("%w: pool %s or username %s", ErrDuplicate, model.Name, model.Username)
+		}
+	}
+
+	r.poolID++
+	_, createdAt := memoryNow()
+	stored := &PoolModel{
+		ID:        r.poolID,
+		Name:      model.Name,
+		Username:  model.Username,
+		Password:  hash,
+		Strategy:  model.Strategy,
+		Limits:    model.Limits,
+		CreatedAt: createdAt,
+	}
+	r.pools = append(r.pools, stored)
+
+	return &PoolModel{
+		ID:       stored.ID,
+		Name:     stored.Name,
+		Username: stored.Username,
+		Password: hash,
+		Strategy: stored.Strategy,
+		Limits:   stored.Limits,
+	}, nil
+}
+
+func (r *MemoryRepository) DeletePool(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := r.pool(name)
+	if stored == nil {
+		return fmt.Errorf("pool %s not found", name)
+	}
+	r.pools = slices.DeleteFunc(r.pools, func(model *PoolModel) bool { return model == stored })
+	return nil
+}
+
+func (r *MemoryRepository) FindAllPools(ctx context.Context) ([]*PoolModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Members are listed in the order the proxies were created, as the SQL
+	// backends do.
+	order := make(map[string]int64, len(r.proxies))
+	for _, proxy := range r.proxies {
+		order[proxy.Username] = proxy.ID
+	}
+
+	var models []*PoolModel
+	for _, stored := range r.pools {
+		model := *stored
+		model.Members = slices.Clone(stored.Members)
+		slices.SortFunc(model.Members, func(a, b string) int { return cmp.Compare(order[a], order[b]) })
+		models = append(models, &model)
+	}
+	return models, nil
+}
+
+func (r *MemoryRepository) AddPoolMember(ctx context.Context, poolName, proxyUsername string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pool := r.pool(poolName)
+	if pool == nil || r.proxy(proxyUsername) == nil || slices.Contains(pool.Members, proxyUsername) {
+		return fmt.Errorf("pool %s or proxy %s not found, or already a member", poolName, proxyUsername)
+	}
+	pool.Members = append(pool.Members, proxyUsername)
+	return nil
+}
+
+func (r *MemoryRepository) RemovePoolMember(ctx context.Context, poolName, proxyUsername string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pool := r.pool(poolName)
+	if pool == nil || !slices.Contains(pool.Members, proxyUsername) {
+		return fmt.Errorf("proxy %s is not a member of pool %s", proxyUsername, poolName)
+	}
+	pool.Members = slices.DeleteFunc(pool.Members, func(member string) bool { return member == proxyUsername })
+	return nil
+}
+
+// AddUsage adds the byte counts of records to the stored totals.
+func (r *MemoryRepository) AddUsage(ctx context.Context, records []*UsageModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, record := range records {
+		i := slices.IndexFunc(r.usage, func(stored *UsageModel) bool {
+			return stored.Username == record.Username && stored.Upstream == record.Upstream && stored.Day == record.Day
+		})
+		if i < 0 {
+			stored := *record
+			r.usage = append(r.usage, &stored)
+			continue
+		}
+		r.usage[i].BytesUp += record.BytesUp
+		r.usage[i].BytesDown += record.BytesDown
+	}
+	return nil
+}
+
+// FindUsage returns the usage recorded on or after the day since (YYYY-MM-DD).
+func (r *MemoryRepository) FindUsage(ctx context.Context, since string) ([]*UsageModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var models []*UsageModel
+	for _, stored := range r.usage {
+		if stored.Day >= since {
+			model := *stored
+			models = append(models, &model)
+		}
+	}
+	slices.SortFunc(models, func(a, b *UsageModel) int {
+		return cmp.Or(cmp.Compare(a.Day, b.Day), cmp.Compare(a.Username, b.Username), cmp.Compare(a.Upstream, b.Upstream))
+	})
+	return models, nil
+}
+
+// AddCheck stores a check, to the second like the SQL backends.
+func (r *MemoryRepository) AddCheck(ctx context.Context, model *CheckModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checkID++
+	stored := *model
+	stored.ID = r.checkID
+	stored.CheckedAt = model.CheckedAt.UTC().Truncate(time.Second)
+	stored.Latency = model.Latency.Truncate(time.Millisecond)
+	r.checks = append(r.checks, &stored)
+	return nil
+}
+
+// FindChecks returns the checks made since the given time, oldest first.
+// An empty username returns the checks of all proxies.
+func (r *MemoryRepository) FindChecks(ctx context.Context, username string, since time.Time) ([]*CheckModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	since = since.UTC().Truncate(time.Second)
+	var models []*CheckModel
+	for _, stored := range r.checks {
+		if stored.CheckedAt.Before(since) || username != "" && stored.Username != username {
+			continue
+		}
+		model := *stored
+		models = append(models, &model)
+	}
+	slices.SortFunc(models, func(a, b *CheckModel) int {
+		return cmp.Or(a.CheckedAt.Compare(b.CheckedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return models, nil
+}
+
+// PruneChecks deletes the checks made before the given time and returns how many were deleted.
+func (r *MemoryRepository) PruneChecks(ctx context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	before = before.UTC().Truncate(time.Second)
+	n := len(r.checks)
+	r.checks = slices.DeleteFunc(r.checks, func(check *CheckModel) bool { return check.CheckedAt.Before(before) })
+	return int64(n - len(r.checks)), nil
+}
+
+func (r *MemoryRepository) Close() error {
+	return nil
+}
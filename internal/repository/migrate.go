@@ -0,0 +1,354 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaTooNew is returned for databases migrated by a newer version,
+// which this one would corrupt by writing to them.
+var ErrSchemaTooNew = errors.New("database schema is newer than this version")
+
+// Migrator is implemented by the backends with a versioned schema.
+type Migrator interface {
+	// Migrate applies the pending migrations in order, each in its own
+	// transaction, and returns them. Databases migrated by a newer version
+	// are refused with ErrSchemaTooNew.
+	Migrate() ([]MigrationStatus, error)
+	// MigrationStatus lists the known migrations, followed by any applied by
+	// a newer version. These come with ErrSchemaTooNew.
+	MigrationStatus() ([]MigrationStatus, error)
+}
+
+// migration moves the schema one version up.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// schema is the migrations of a SQL backend and how its queries differ.
+type schema struct {
+	migrations []migration
+	// rebind turns the ? placeholders of a query into those of the backend.
+	rebind func(query string) string
+	// lock is run first in every migration transaction, to keep other
+	// processes from migrating at the same time. Empty if the database
+	// locks itself.
+	lock string
+	// hasTable tells whether the table named by its argument exists.
+	hasTable string
+}
+
+func (s schema) version() int {
+	return s.migrations[len(s.migrations)-1].version
+}
+
+// sqliteSchema migrates SQLite databases. Databases created before
+// schema_migrations existed may already have any of the changes up to
+// hash_passwords, so those only create and add what is missing.
+var sqliteSchema = schema{migrations: []migration{
+	{1, "create_proxies", execSQL(`
+	CREATE TABLE IF NOT EXISTS proxies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		password TEXT NOT NULL,
+		target TEXT NOT NULL,
+		failed_checks INTEGER DEFAULT 0,
+		last_check_at DATETIME DEFAULT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_username ON proxies(username);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_target ON proxies(target);
+	`)},
+	{2, "add_proxy_checks_columns", addColumns("proxies", []columnDef{
+		{"failed_checks", "INTEGER DEFAULT 0"},
+		{"last_check_at", "DATETIME DEFAULT NULL"},
+	})},
+	{3, "add_upstream_credentials", addColumns("proxies", []columnDef{
+		{"upstream_username", "TEXT NOT NULL DEFAULT ''"},
+		{"upstream_password", "TEXT NOT NULL DEFAULT ''"},
+	})},
+	{4, "add_proxy_limits", addColumns("proxies", []columnDef{
+		{"rate_limit", "REAL NOT NULL DEFAULT 0"},
+		{"rate_burst", "INTEGER NOT NULL DEFAULT 0"},
+		{"max_conns", "INTEGER NOT NULL DEFAULT 0"},
+		{"daily_quota", "INTEGER NOT NULL DEFAULT 0"},
+		{"monthly_quota", "INTEGER NOT NULL DEFAULT 0"},
+	})},
+	{5, "add_proxy_status", addColumns("proxies", []columnDef{
+		{"status", "TEXT NOT NULL DEFAULT 'active'"},
+	})},
+	{6, "add_exit_info", addColumns("proxies", []columnDef{
+		{"exit_ip", "TEXT NOT NULL DEFAULT ''"},
+		{"country", "TEXT NOT NULL DEFAULT ''"},
+		{"asn", "INTEGER NOT NULL DEFAULT 0"},
+		{"as_org", "TEXT NOT NULL DEFAULT ''"},
+		{"anonymity", "TEXT NOT NULL DEFAULT ''"},
+	})},
+	{7, "add_tags", addColumns("proxies", []columnDef{
+		{"tags", "TEXT NOT NULL DEFAULT ''"},
+	})},
+	{8, "create_pools", execSQL(`
+	CREATE TABLE IF NOT EXISTS pools (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL,
+		username TEXT UNIQUE NOT NULL,
+		password TEXT NOT NULL,
+		strategy TEXT NOT NULL DEFAULT 'round_robin',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS pool_members (
+		pool_id INTEGER NOT NULL,
+		proxy_id INTEGER NOT NULL,
+		PRIMARY KEY (pool_id, proxy_id)
+	);
+	`)},
+	{9, "add_pool_limits", addColumns("pools", []columnDef{
+		{"rate_limit", "REAL NOT NULL DEFAULT 0"},
+		{"rate_burst", "INTEGER NOT NULL DEFAULT 0"},
+		{"max_conns", "INTEGER NOT NULL DEFAULT 0"},
+		{"daily_quota", "INTEGER NOT NULL DEFAULT 0"},
+		{"monthly_quota", "INTEGER NOT NULL DEFAULT 0"},
+	})},
+	{10, "create_usage", execSQL(`
+	CREATE TABLE IF NOT EXISTS usage (
+		username TEXT NOT NULL,
+		upstream TEXT NOT NULL,
+		day TEXT NOT NULL,
+		bytes_up INTEGER NOT NULL DEFAULT 0,
+		bytes_down INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (username, upstream, day)
+	);
+	`)},
+	{11, "create_proxy_checks", execSQL(`
+	CREATE TABLE IF NOT EXISTS proxy_checks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		checked_at DATETIME NOT NULL,
+		success INTEGER NOT NULL,
+		latency_ms INTEGER NOT NULL DEFAULT 0,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		error_class TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_proxy_checks_username ON proxy_checks(username, checked_at);
+	CREATE INDEX IF NOT EXISTS idx_proxy_checks_checked_at ON proxy_checks(checked_at);
+	`)},
+	{12, "hash_passwords", hashPlaintextPasswords(sqliteRebind)},
+}, rebind: sqliteRebind, hasTable: "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)"}
+
+// sqliteRebind returns query as it is, SQLite takes ? placeholders.
+func sqliteRebind(query string) string {
+	return query
+}
+
+// MigrationStatus is a migration and when it was applied, empty if pending.
+type MigrationStatus struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+func (s MigrationStatus) Applied() bool {
+	return s.AppliedAt != ""
+}
+
+func (r *SQLiteRepository) Migrate() ([]MigrationStatus, error) {
+	return migrate(r.db, sqliteSchema)
+}
+
+func (r *SQLiteRepository) MigrationStatus() ([]MigrationStatus, error) {
+	return migrationStatus(r.db, sqliteSchema)
+}
+
+func migrate(db *sql.DB, s schema) ([]MigrationStatus, error) {
+	if _, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	);
+	`); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	statuses, err := migrationStatus(db, s)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []MigrationStatus
+	for i, status := range statuses {
+		if status.Applied() {
+			continue
+		}
+		status.AppliedAt = time.Now().UTC().Format(time.DateTime)
+		if err := applyMigration(db, s, s.migrations[i], status.AppliedAt); err != nil {
+			return applied, fmt.Errorf("failed to apply migration %d %s: %w", status.Version, status.Name, err)
+		}
+		applied = append(applied, status)
+	}
+
+	return applied, nil
+}
+
+// migrationStatus reads the applied migrations without writing to the
+// database: without schema_migrations, every migration is pending.
+func migrationStatus(db *sql.DB, s schema) ([]MigrationStatus, error) {
+	var exists bool
+	if err := db.QueryRow(s.rebind(s.hasTable), "schema_migrations").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up schema_migrations: %w", err)
+	}
+
+	var recorded []MigrationStatus
+	if exists {
+		var err error
+		if recorded, err = appliedMigrations(db); err != nil {
+			return nil, err
+		}
+	}
+
+	applied := map[int]MigrationStatus{}
+	var newer []MigrationStatus
+	latest := s.version()
+	for _, status := range recorded {
+		applied[status.Version] = status
+		if status.Version > latest {
+			newer = append(newer, status)
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(s.migrations)+len(newer))
+	for _, m := range s.migrations {
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if done, ok := applied[m.version]; ok {
+			status.AppliedAt = done.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	statuses = append(statuses, newer...)
+
+	if len(newer) > 0 {
+		return statuses, fmt.Errorf("%w: version %d, this version knows up to %d",
+			ErrSchemaTooNew, newer[len(newer)-1].Version, latest)
+	}
+	return statuses, nil
+}
+
+// appliedMigrations reads schema_migrations in version order.
+func appliedMigrations(db *sql.DB) ([]MigrationStatus, error) {
+	rows, err := db.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query migrations: %w", err)
+	}
+	defer rows.Close()
+
+	var statuses []MigrationStatus
+	for rows.Next() {
+		var status MigrationStatus
+		var appliedAt time.Time
+		if err := rows.Scan(&status.Version, &status.Name, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan migration: %w", err)
+		}
+		status.AppliedAt = appliedAt.UTC().Format(time.DateTime)
+		statuses = append(statuses, status)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	return statuses, nil
+}
+
+func applyMigration(db *sql.DB, s schema, m migration, appliedAt string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if s.lock != "" {
+		if _, err := tx.Exec(s.lock); err != nil {
+			return fmt.Errorf("failed to lock migrations: %w", err)
+		}
+	}
+
+	// Another process may have applied it since the status was read.
+	var exists bool
+	if err := tx.QueryRow(s.rebind("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)"), m.version).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to query migration: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"), m.version, m.name, appliedAt); err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func execSQL(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+type columnDef struct {
+	name       string
+	definition string
+}
+
+func addColumns(table string, defs []columnDef) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		return addMissingColumns(tx, table, defs)
+	}
+}
+
+// addMissingColumns adds the columns a table created by an older version lacks.
+func addMissingColumns(tx *sql.Tx, table string, defs []columnDef) error {
+	columns := map[string]bool{}
+
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info(%s);`, table))
+	if err != nil {
+		return fmt.Errorf("failed to get table info: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			ctype      string
+			notnull    int
+			dflt_value sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt_value, &pk); err != nil {
+			return fmt.Errorf("failed to scan table info: %w", err)
+		}
+		columns[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read table info: %w", err)
+	}
+
+	for _, def := range defs {
+		if columns[def.name] {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, table, def.name, def.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s: %w", def.name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// baselineDB writes a database file as created by the first release.
+func baselineDB(t *testing.T) string {
+	t.Helper()
+
+	schema, err := os.ReadFile(filepath.Join("testdata", "baseline.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "proxies.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	ctx := context.Background()
+	repo, err := OpenSQLiteRepository(baselineDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	statuses, err := repo.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != len(sqliteSchema.migrations) || statuses[0].Applied() {
+		t.Fatalf("expected every migration pending, got %+v", statuses)
+	}
+
+	applied, err := repo.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(sqliteSchema.migrations) || applied[len(applied)-1].Version != sqliteSchema.version() {
+		t.Fatalf("unexpected applied migrations: %+v", applied)
+	}
+
+	alice, err := repo.FindByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Target != "10.0.0.1:3128" || alice.FailedChecks != 2 || alice.Status != "active" || !VerifyPassword(alice.Password, "secret") {
+		t.Fatalf("unexpected migrated proxy: %+v", alice)
+	}
+	if _, err := repo.CreatePool(ctx, &PoolModel{Name: "p", Username: "pool", Password: "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err = repo.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied() {
+			t.Fatalf("migration %d %s still pending", status.Version, status.Name)
+		}
+	}
+
+	if applied, err := repo.Migrate(); err != nil || len(applied) != 0 {
+		t.Fatalf("expected nothing to migrate, got %+v, %v", applied, err)
+	}
+}
+
+func TestMigrationStatusLeavesDatabaseAlone(t *testing.T) {
+	repo, err := OpenSQLiteRepository(baselineDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	statuses, err := repo.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != sqliteSchema.version() || slices.ContainsFunc(statuses, MigrationStatus.Applied) {
+		t.Fatalf("expected every migration pending, got %+v", statuses)
+	}
+
+	var exists bool
+	if err := repo.db.QueryRow(sqliteSchema.hasTable, "schema_migrations").Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("migration status created schema_migrations")
+	}
+}
+
+func TestMigrateRefusesDowngrade(t *testing.T) {
+	path := baselineDB(t)
+	repo, err := NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer := sqliteSchema.version() + 1
+	if _, err := repo.db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from_the_future', '2030-01-01 00:00:00')", newer); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := repo.MigrationStatus()
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+	if last := statuses[len(statuses)-1]; last.Version != newer || last.Name != "from_the_future" {
+		t.Fatalf("expected the newer migration listed last, got %+v", last)
+	}
+	repo.Close()
+
+	if _, err := NewSQLiteRepository(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func TestMigrateRollsBack(t *testing.T) {
+	repo, err := OpenSQLiteRepository(baselineDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	failing := sqliteSchema
+	failing.migrations = append(slices.Clip(sqliteSchema.migrations), migration{
+		version: sqliteSchema.version() + 1,
+		name:    "broken",
+		up: func(tx *sql.Tx) error {
+			if _, err := tx.Exec("CREATE TABLE half_done (id INTEGER)"); err != nil {
+				return err
+			}
+			_, err := tx.Exec("ALTER TABLE missing ADD COLUMN x TEXT")
+			return err
+		},
+	})
+
+	applied, err := migrate(repo.db, failing)
+	if err == nil {
+		t.Fatal("expected the broken migration to fail")
+	}
+	if len(applied) != len(sqliteSchema.migrations) {
+		t.Fatalf("expected the earlier migrations applied, got %d", len(applied))
+	}
+
+	var tables int
+	if err := repo.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatal("expected the broken migration rolled back")
+	}
+	statuses, err := migrationStatus(repo.db, failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[len(statuses)-1].Applied() {
+		t.Fatal("expected the broken migration pending")
+	}
+}
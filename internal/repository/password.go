@@ -0,0 +1,131 @@
+package repository
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Parameters of new argon2id password hashes, as recommended by OWASP. Stored
+// hashes carry their own parameters, so changing these only affects new ones.
+const (
+	argonMemory  = 19 * 1024
+	argonTime    = 2
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+
+	argonPrefix = "$argon2id$"
+)
+
+// ErrNotHashed is returned when a password to store as it is was not hashed
+// with HashPassword.
+var ErrNotHashed = errors.New("password is not hashed")
+
+// HashPassword returns the salted argon2id hash of password in the PHC string
+// format.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argonPrefix, argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// IsPasswordHash reports whether a stored password is hashed.
+func IsPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, argonPrefix)
+}
+
+// requireHash returns ErrNotHashed unless the password of username is hashed.
+func requireHash(username, hash string) error {
+	if !IsPasswordHash(hash) {
+		return fmt.Errorf("%w: user %s", ErrNotHashed, username)
+	}
+	return nil
+}
+
+// VerifyPassword reports whether password matches the stored one in constant
+// time. Stored passwords that are not hashed yet are compared as they are.
+func VerifyPassword(stored, password string) bool {
+	if !IsPasswordHash(stored) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+
+	var (
+		version      int
+		memory, time uint32
+		threads      uint8
+	)
+	parts := strings.Split(strings.TrimPrefix(stored, argonPrefix), "$")
+	if len(parts) != 4 {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// hashPlaintextPasswords returns a migration hashing the passwords stored in
+// plaintext by older versions.
+func hashPlaintextPasswords(rebind func(query string) string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, table := range []string{"proxies", "pools"} {
+			rows, err := tx.Query(fmt.Sprintf("SELECT username, password FROM %s WHERE password NOT LIKE '%s%%'", table, argonPrefix))
+			if err != nil {
+				return fmt.Errorf("failed to query passwords: %w", err)
+			}
+
+			plaintext := map[string]string{}
+			for rows.Next() {
+				var username, password string
+				if err := rows.Scan(&username, &password); err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to scan password: %w", err)
+				}
+				plaintext[username] = password
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to read passwords: %w", err)
+			}
+
+			for username, password := range plaintext {
+				hash, err := HashPassword(password)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.Exec(rebind(fmt.Sprintf("UPDATE %s SET password = ? WHERE username = ?", table)), hash, username); err != nil {
+					return fmt.Errorf("failed to hash password of %s: %w", username, err)
+				}
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordHashing(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPasswordHash(hash) || !VerifyPassword(hash, "secret") || VerifyPassword(hash, "wrong") {
+		t.Fatalf("unexpected verification of %s", hash)
+	}
+	if again, _ := HashPassword(hash); again == hash || !VerifyPassword(again, hash) {
+		t.Fatalf("expected a hash to be hashed like any password, got %s", again)
+	}
+	if other, _ := HashPassword("secret"); other == hash {
+		t.Fatal("expected a new salt for every hash")
+	}
+	if !VerifyPassword("plain", "plain") || VerifyPassword("plain", "other") {
+		t.Fatal("unexpected verification of a plaintext password")
+	}
+	if VerifyPassword(argonPrefix+"v=19$m=1,t=1,p=1$bad", "") {
+		t.Fatal("expected a malformed hash to be refused")
+	}
+}
+
+func TestHashPlaintextPasswords(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "proxies.db")
+	repo, err := NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows written by versions that stored passwords in plaintext.
+	if _, err := repo.db.Exec("INSERT INTO proxies (username, password, target) VALUES ('a', 'secret', '10.0.0.1:3128')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.db.Exec("INSERT INTO pools (name, username, password) VALUES ('p', 'b', 'other')"); err != nil {
+		t.Fatal(err)
+	}
+	// As if they were written before hash_passwords.
+	if _, err := repo.db.Exec("DELETE FROM schema_migrations WHERE version = 12"); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+
+	repo, err = NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	proxy, err := repo.FindByUsername(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPasswordHash(proxy.Password) || !VerifyPassword(proxy.Password, "secret") {
+		t.Fatalf("proxy password not hashed: %s", proxy.Password)
+	}
+
+	pools, err := repo.FindAllPools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 1 {
+		t.Fatalf("expected 1 pool, got %d", len(pools))
+	}
+	if pool := pools[0]; !IsPasswordHash(pool.Password) || !VerifyPassword(pool.Password, "other") {
+		t.Fatalf("pool password not hashed: %s", pool.Password)
+	}
+}
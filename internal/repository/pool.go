@@ -0,0 +1,174 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+)
+
+type PoolModel struct {
+	ID        int64
+	Name      string
+	Username  string
+	Password  string
+	Strategy  string
+	Limits    Limits
+	Members   []string
+	CreatedAt string
+}
+
+// CreatePool stores a pool, hashing its password.
+func (r *SQLiteRepository) CreatePool(ctx context.Context, model *PoolModel) (*PoolModel, error) {
+	hash, err := HashPassword(model.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.q.ExecContext(ctx,
+		"INSERT INTO pools (name, username, password, strategy, rate_limit, rate_burst, max_conns, daily_quota, monthly_quota) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		model.Name, model.Username, hash, model.Strategy,
+		model.Limits.RateLimit, model.Limits.RateBurst, model.Limits.MaxConns, model.Limits.DailyQuota, model.Limits.MonthlyQuota,
+	)
+	if isUniqueViolation(err) {
+		return nil, fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert pool: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return &PoolModel{
+		ID:       id,
+		Name:     model.Name,
+		Username: model.Username,
+		Password: hash,
+		Strategy: model.Strategy,
+		Limits:   model.Limits,
+	}, nil
+}
+
+func (r *SQLiteRepository) DeletePool(ctx context.Context, name string) error {
+	return inTx(ctx, r.db, r.q, func(tx querier) error {
+		if _, err := tx.ExecContext(ctx,
+			"DELETE FROM pool_members WHERE pool_id IN (SELECT id FROM pools WHERE name = ?)",
+			name,
+		); err != nil {
+			return fmt.Errorf("failed to delete pool members: %w", err)
+		}
+
+		result, err := tx.ExecContext(ctx, "DELETE FROM pools WHERE name = ?", name)
+		if err != nil {
+			return fmt.Errorf("failed to delete pool: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+
+		if rowsAffected == 0 {
+			return fmt.Errorf("pool %s not found", name)
+		}
+
+		return nil
+	})
+}
+
+func (r *SQLiteRepository) FindAllPools(ctx context.Context) ([]*PoolModel, error) {
+	rows, err := r.q.QueryContext(ctx, "SELECT id, name, username, password, strategy, rate_limit, rate_burst, max_conns, daily_quota, monthly_quota, created_at FROM pools")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pools: %w", err)
+	}
+	defer rows.Close()
+
+	var models []*PoolModel
+	byID := make(map[int64]*PoolModel)
+	for rows.Next() {
+		var model PoolModel
+		if err := rows.Scan(&model.ID, &model.Name, &model.Username, &model.Password, &model.Strategy,
+			&model.Limits.RateLimit, &model.Limits.RateBurst, &model.Limits.MaxConns, &model.Limits.DailyQuota, &model.Limits.MonthlyQuota, &model.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan pool: %w", err)
+		}
+		models = append(models, &model)
+		byID[model.ID] = &model
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	memberRows, err := r.q.QueryContext(ctx,
+		"SELECT pm.pool_id, p.username FROM pool_members pm JOIN proxies p ON p.id = pm.proxy_id ORDER BY p.id",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pool members: %w", err)
+	}
+	defer memberRows.Close()
+
+	for memberRows.Next() {
+		var (
+			poolID   int64
+			username string
+		)
+		if err := memberRows.Scan(&poolID, &username); err != nil {
+			return nil, fmt.Errorf("failed to scan pool member: %w", err)
+		}
+		if pool, ok := byID[poolID]; ok {
+			pool.Members = append(pool.Members, username)
+		}
+	}
+
+	if err := memberRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return models, nil
+}
+
+func (r *SQLiteRepository) AddPoolMember(ctx context.Context, poolName, proxyUsername string) error {
+	result, err := r.q.ExecContext(ctx,
+		`INSERT OR IGNORE INTO pool_members (pool_id, proxy_id)
+		SELECT pools.id, proxies.id FROM pools, proxies WHERE pools.name = ? AND proxies.username = ?`,
+		poolName, proxyUsername,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add pool member: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("pool %s or proxy %s not found, or already a member", poolName, proxyUsername)
+	}
+
+	return nil
+}
+
+func (r *SQLiteRepository) RemovePoolMember(ctx context.Context, poolName, proxyUsername string) error {
+	result, err := r.q.ExecContext(ctx,
+		`DELETE FROM pool_members
+		WHERE pool_id = (SELECT id FROM pools WHERE name = ?)
+		AND proxy_id = (SELECT id FROM proxies WHERE username = ?)`,
+		poolName, proxyUsername,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to remove pool member: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("proxy %s is not a member of pool %s", proxyUsername, poolName)
+	}
+
+	return nil
+}
@@ -1,115 +1,196 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// ErrDuplicate is returned when a username or target is already taken.
+var ErrDuplicate = errors.New("proxy already exists")
+
+// Limits caps the traffic of a router user. Zero rate and connection values
+// fall back to the global defaults, zero quotas mean no quota. Quotas are in
+// bytes moved in both directions per UTC day and month.
+type Limits struct {
+	RateLimit    float64
+	RateBurst    int
+	MaxConns     int
+	DailyQuota   int64
+	MonthlyQuota int64
+}
+
+// Proxy statuses. Degraded proxies failed recent checks but still route,
+// quarantined ones failed too many and only get re-checked, disabled ones are
+// taken out of service by an operator and not checked at all.
+const (
+	StatusActive      = "active"
+	StatusDegraded    = "degraded"
+	StatusQuarantined = "quarantined"
+	StatusDisabled    = "disabled"
+)
+
+// Statuses lists the valid proxy statuses.
+var Statuses = []string{StatusActive, StatusDegraded, StatusQuarantined, StatusDisabled}
+
+// Anonymity levels of an upstream. Transparent proxies reveal the client IP,
+// anonymous ones reveal that a proxy is used, elite ones reveal neither.
+const (
+	AnonymityTransparent = "transparent"
+	AnonymityAnonymous   = "anonymous"
+	AnonymityElite       = "elite"
+)
+
+// ExitInfo is what the checker learned about the exit of an upstream. Country
+// is an ISO 3166-1 alpha-2 code.
+type ExitInfo struct {
+	IP        string
+	Country   string
+	ASN       uint
+	ASOrg     string
+	Anonymity string
+}
+
 type ProxyModel struct {
-	ID           int64
-	Username     string
-	Password     string
-	Target       string
-	FailedChecks int
-	LastCheckAt  string
-	CreatedAt    string
+	ID               int64
+	Username         string
+	Password         string
+	Target           string
+	UpstreamUsername string
+	UpstreamPassword string
+	Limits           Limits
+	Status           string
+	Exit             ExitInfo
+	Tags             []string
+	FailedChecks     int
+	LastCheckAt      string
+	CreatedAt        string
+}
+
+// IProxyStore reads and writes proxies, pools, usage and check history. The
+// context of each call cancels its queries.
+type IProxyStore interface {
+	Create(ctx context.Context, model *ProxyModel) (*ProxyModel, error)
+	Update(ctx context.Context, model *ProxyModel) error
+	Delete(ctx context.Context, username string) error
+	FindByUsername(ctx context.Context, username string) (*ProxyModel, error)
+	FindAll(ctx context.Context) ([]*ProxyModel, error)
+	IncrementFailedChecks(ctx context.Context, username string) error
+	ResetFailedChecks(ctx context.Context, username string) error
+	RecordCheckResult(ctx context.Context, username string, success bool) (*ProxyModel, error)
+	SetStatus(ctx context.Context, username, status string) error
+	SetExitInfo(ctx context.Context, username string, info ExitInfo) error
+	SetTags(ctx context.Context, username string, tags []string) error
+	SetLimits(ctx context.Context, username string, limits Limits) error
+	SetPassword(ctx context.Context, username, hash string) error
+
+	CreatePool(ctx context.Context, model *PoolModel) (*PoolModel, error)
+	DeletePool(ctx context.Context, name string) error
+	FindAllPools(ctx context.Context) ([]*PoolModel, error)
+	AddPoolMember(ctx context.Context, poolName, proxyUsername string) error
+	RemovePoolMember(ctx context.Context, poolName, proxyUsername string) error
+
+	AddUsage(ctx context.Context, records []*UsageModel) error
+	FindUsage(ctx context.Context, since string) ([]*UsageModel, error)
+
+	AddCheck(ctx context.Context, model *CheckModel) error
+	FindChecks(ctx context.Context, username string, since time.Time) ([]*CheckModel, error)
+	PruneChecks(ctx context.Context, before time.Time) (int64, error)
 }
 
 type IProxyRepository interface {
-	Create(username, password, target string) (*ProxyModel, error)
-	Update(username, password, target string) error
-	Delete(username string) error
-	FindByUsername(username string) (*ProxyModel, error)
-	FindAll() ([]*ProxyModel, error)
-	IncrementFailedChecks(username string) error
-	ResetFailedChecks(username string) error
+	IProxyStore
+
+	// WithTx runs fn with a store whose changes are committed together when
+	// fn returns nil and discarded otherwise.
+	WithTx(ctx context.Context, fn func(tx IProxyStore) error) error
+
 	Close() error
 }
 
 type SQLiteRepository struct {
 	db *sql.DB
+	q  querier
 }
 
+// NewSQLiteRepository opens the database and applies pending migrations.
 func NewSQLiteRepository(dbPath string) (*SQLiteRepository, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	repo, err := OpenSQLiteRepository(dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
-
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS proxies (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT UNIQUE NOT NULL,
-		password TEXT NOT NULL,
-		target TEXT NOT NULL,
-		failed_checks INTEGER DEFAULT 0,
-    	last_check_at DATETIME DEFAULT NULL, 
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	CREATE INDEX IF NOT EXISTS idx_username ON proxies(username);
-	CREATE UNIQUE INDEX IF NOT EXISTS idx_target ON proxies(target);
-	`
-
-	if _, err := db.Exec(createTableSQL); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to create table: %w", err)
+		return nil, err
 	}
 
-	if err := migrateProxiesTable(db); err != nil {
-		db.Close()
+	if _, err := repo.Migrate(); err != nil {
+		repo.Close()
 		return nil, err
 	}
 
-	return &SQLiteRepository{db: db}, nil
+	return repo, nil
 }
 
-func migrateProxiesTable(db *sql.DB) error {
-	columns := map[string]bool{}
-
-	rows, err := db.Query(`PRAGMA table_info(proxies);`)
-	if err != nil {
-		return fmt.Errorf("failed to get table info: %w", err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var (
-			cid        int
-			name       string
-			ctype      string
-			notnull    int
-			dflt_value sql.NullString
-			pk         int
-		)
-		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt_value, &pk); err != nil {
-			return fmt.Errorf("failed to scan table info: %w", err)
+// sqliteOptions make writers wait for the database lock instead of failing
+// with SQLITE_BUSY, and take the write lock when a transaction begins so two
+// transactions never deadlock upgrading their read locks.
+var sqliteOptions = []string{"_busy_timeout=5000", "_txlock=immediate"}
+
+// sqliteDSN adds the sqliteOptions the path does not set itself.
+func sqliteDSN(dbPath string) string {
+	dsn := dbPath
+	for _, option := range sqliteOptions {
+		key, _, _ := strings.Cut(option, "=")
+		if strings.Contains(dbPath, key+"=") {
+			continue
 		}
-		columns[name] = true
-	}
-
-	if !columns["failed_checks"] {
-		if _, err := db.Exec(`ALTER TABLE proxies ADD COLUMN failed_checks INTEGER DEFAULT 0;`); err != nil {
-			return fmt.Errorf("failed to add column failed_checks: %w", err)
+		if strings.Contains(dsn, "?") {
+			dsn += "&" + option
+		} else {
+			dsn += "?" + option
 		}
 	}
+	return dsn
+}
 
-	if !columns["last_check_at"] {
-		if _, err := db.Exec(`ALTER TABLE proxies ADD COLUMN last_check_at DATETIME DEFAULT NULL;`); err != nil {
-			return fmt.Errorf("failed to add column last_check_at: %w", err)
-		}
+// OpenSQLiteRepository opens the database without migrating it.
+func OpenSQLiteRepository(dbPath string) (*SQLiteRepository, error) {
+	db, err := sql.Open("sqlite3", sqliteDSN(dbPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	return nil
+	return &SQLiteRepository{db: db, q: db}, nil
 }
 
-func (r *SQLiteRepository) Create(username, password, target string) (*ProxyModel, error) {
-	result, err := r.db.Exec(
-		"INSERT INTO proxies (username, password, target) VALUES (?, ?, ?)",
-		username, password, target,
+const sqliteProxyColumns = "id, username, password, target, upstream_username, upstream_password, rate_limit, rate_burst, max_conns, daily_quota, monthly_quota, status, exit_ip, country, asn, as_org, anonymity, tags, failed_checks, COALESCE(last_check_at, ''), created_at"
+
+// WithTx runs fn in a transaction. Methods of tx made of several statements
+// join it rather than starting their own.
+func (r *SQLiteRepository) WithTx(ctx context.Context, fn func(tx IProxyStore) error) error {
+	return inTx(ctx, r.db, r.q, func(tx querier) error {
+		return fn(&SQLiteRepository{db: r.db, q: tx})
+	})
+}
+
+// Create stores a proxy, hashing its password.
+func (r *SQLiteRepository) Create(ctx context.Context, model *ProxyModel) (*ProxyModel, error) {
+	hash, err := HashPassword(model.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.q.ExecContext(ctx,
+		"INSERT INTO proxies (username, password, target, upstream_username, upstream_password, rate_limit, rate_burst, max_conns, daily_quota, monthly_quota, tags) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		model.Username, hash, model.Target, model.UpstreamUsername, model.UpstreamPassword,
+		model.Limits.RateLimit, model.Limits.RateBurst, model.Limits.MaxConns, model.Limits.DailyQuota, model.Limits.MonthlyQuota,
+		joinTags(model.Tags),
 	)
+	if isUniqueViolation(err) {
+		return nil, fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert proxy: %w", err)
 	}
@@ -120,18 +201,35 @@ func (r *SQLiteRepository) Create(username, password, target string) (*ProxyMode
 	}
 
 	return &ProxyModel{
-		ID:       id,
-		Username: username,
-		Password: password,
-		Target:   target,
+		ID:               id,
+		Username:         model.Username,
+		Password:         hash,
+		Target:           model.Target,
+		UpstreamUsername: model.UpstreamUsername,
+		UpstreamPassword: model.UpstreamPassword,
+		Limits:           model.Limits,
+		Status:           StatusActive,
+		Tags:             model.Tags,
 	}, nil
 }
 
-func (r *SQLiteRepository) Update(username, password, target string) error {
-	result, err := r.db.Exec(
-		"UPDATE proxies SET password = ?, target = ? WHERE username = ?",
-		password, target, username,
+// Update changes a proxy. Its password must be hashed already, see
+// HashPassword; an empty password keeps the stored one.
+func (r *SQLiteRepository) Update(ctx context.Context, model *ProxyModel) error {
+	hash := model.Password
+	if hash != "" {
+		if err := requireHash(model.Username, hash); err != nil {
+			return err
+		}
+	}
+
+	result, err := r.q.ExecContext(ctx,
+		"UPDATE proxies SET password = COALESCE(NULLIF(?, ''), password), target = ?, upstream_username = ?, upstream_password = ?, tags = ? WHERE username = ?",
+		hash, model.Target, model.UpstreamUsername, model.UpstreamPassword, joinTags(model.Tags), model.Username,
 	)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to update proxy: %w", err)
 	}
@@ -142,36 +240,54 @@ func (r *SQLiteRepository) Update(username, password, target string) error {
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("proxy with username %s not found", username)
+		return fmt.Errorf("proxy with username %s not found", model.Username)
 	}
 
 	return nil
 }
 
-func (r *SQLiteRepository) Delete(username string) error {
-	result, err := r.db.Exec("DELETE FROM proxies WHERE username = ?", username)
-	if err != nil {
-		return fmt.Errorf("failed to delete proxy: %w", err)
-	}
+func (r *SQLiteRepository) Delete(ctx context.Context, username string) error {
+	return inTx(ctx, r.db, r.q, func(tx querier) error {
+		if _, err := tx.ExecContext(ctx,
+			"DELETE FROM pool_members WHERE proxy_id IN (SELECT id FROM proxies WHERE username = ?)",
+			username,
+		); err != nil {
+			return fmt.Errorf("failed to delete pool memberships: %w", err)
+		}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM proxy_checks WHERE username = ?", username); err != nil {
+			return fmt.Errorf("failed to delete check history: %w", err)
+		}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("proxy with username %s not found", username)
-	}
+		result, err := tx.ExecContext(ctx, "DELETE FROM proxies WHERE username = ?", username)
+		if err != nil {
+			return fmt.Errorf("failed to delete proxy: %w", err)
+		}
 
-	return nil
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+
+		if rowsAffected == 0 {
+			return fmt.Errorf("proxy with username %s not found", username)
+		}
+
+		return nil
+	})
 }
 
-func (r *SQLiteRepository) FindByUsername(username string) (*ProxyModel, error) {
-	var model ProxyModel
-	err := r.db.QueryRow(
-		"SELECT id, username, password, target, failed_checks, created_at FROM proxies WHERE username = ?",
+func (r *SQLiteRepository) FindByUsername(ctx context.Context, username string) (*ProxyModel, error) {
+	var (
+		model ProxyModel
+		tags  string
+	)
+	err := r.q.QueryRowContext(ctx,
+		"SELECT "+sqliteProxyColumns+" FROM proxies WHERE username = ?",
 		username,
-	).Scan(&model.ID, &model.Username, &model.Password, &model.Target, &model.FailedChecks, &model.CreatedAt)
+	).Scan(&model.ID, &model.Username, &model.Password, &model.Target, &model.UpstreamUsername, &model.UpstreamPassword,
+		&model.Limits.RateLimit, &model.Limits.RateBurst, &model.Limits.MaxConns, &model.Limits.DailyQuota, &model.Limits.MonthlyQuota, &model.Status,
+		&model.Exit.IP, &model.Exit.Country, &model.Exit.ASN, &model.Exit.ASOrg, &model.Exit.Anonymity, &tags, &model.FailedChecks, &model.LastCheckAt, &model.CreatedAt)
 
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
@@ -179,12 +295,13 @@ func (r *SQLiteRepository) FindByUsername(username string) (*ProxyModel, error)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query proxy: %w", err)
 	}
+	model.Tags = splitTags(tags)
 
 	return &model, nil
 }
 
-func (r *SQLiteRepository) FindAll() ([]*ProxyModel, error) {
-	rows, err := r.db.Query("SELECT id, username, password, target, failed_checks, created_at FROM proxies")
+func (r *SQLiteRepository) FindAll(ctx context.Context) ([]*ProxyModel, error) {
+	rows, err := r.q.QueryContext(ctx, "SELECT "+sqliteProxyColumns+" FROM proxies")
 	if err != nil {
 		return nil, fmt.Errorf("failed to query proxies: %w", err)
 	}
@@ -192,10 +309,16 @@ func (r *SQLiteRepository) FindAll() ([]*ProxyModel, error) {
 
 	var models []*ProxyModel
 	for rows.Next() {
-		var model ProxyModel
-		if err := rows.Scan(&model.ID, &model.Username, &model.Password, &model.Target, &model.FailedChecks, &model.CreatedAt); err != nil {
+		var (
+			model ProxyModel
+			tags  string
+		)
+		if err := rows.Scan(&model.ID, &model.Username, &model.Password, &model.Target, &model.UpstreamUsername, &model.UpstreamPassword,
+			&model.Limits.RateLimit, &model.Limits.RateBurst, &model.Limits.MaxConns, &model.Limits.DailyQuota, &model.Limits.MonthlyQuota, &model.Status,
+			&model.Exit.IP, &model.Exit.Country, &model.Exit.ASN, &model.Exit.ASOrg, &model.Exit.Anonymity, &tags, &model.FailedChecks, &model.LastCheckAt, &model.CreatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan proxy: %w", err)
 		}
+		model.Tags = splitTags(tags)
 		models = append(models, &model)
 	}
 
@@ -206,8 +329,8 @@ func (r *SQLiteRepository) FindAll() ([]*ProxyModel, error) {
 	return models, nil
 }
 
-func (r *SQLiteRepository) IncrementFailedChecks(username string) error {
-	result, err := r.db.Exec(
+func (r *SQLiteRepository) IncrementFailedChecks(ctx context.Context, username string) error {
+	result, err := r.q.ExecContext(ctx,
 		"UPDATE proxies SET failed_checks = failed_checks + 1, last_check_at = CURRENT_TIMESTAMP WHERE username = ?",
 		username,
 	)
@@ -227,8 +350,8 @@ func (r *SQLiteRepository) IncrementFailedChecks(username string) error {
 	return nil
 }
 
-func (r *SQLiteRepository) ResetFailedChecks(username string) error {
-	result, err := r.db.Exec(
+func (r *SQLiteRepository) ResetFailedChecks(ctx context.Context, username string) error {
+	result, err := r.q.ExecContext(ctx,
 		"UPDATE proxies SET failed_checks = 0, last_check_at = CURRENT_TIMESTAMP WHERE username = ?",
 		username,
 	)
@@ -248,6 +371,156 @@ func (r *SQLiteRepository) ResetFailedChecks(username string) error {
 	return nil
 }
 
+// RecordCheckResult resets the failed checks of a proxy after a passed check
+// or counts a failed one, and returns the proxy as updated in the same
+// statement.
+func (r *SQLiteRepository) RecordCheckResult(ctx context.Context, username string, success bool) (*ProxyModel, error) {
+	var (
+		model ProxyModel
+		tags  string
+	)
+	err := r.q.QueryRowContext(ctx,
+		"UPDATE proxies SET failed_checks = CASE WHEN ? THEN 0 ELSE failed_checks + 1 END, last_check_at = CURRENT_TIMESTAMP WHERE username = ? RETURNING "+sqliteProxyColumns,
+		success, username,
+	).Scan(&model.ID, &model.Username, &model.Password, &model.Target, &model.UpstreamUsername, &model.UpstreamPassword,
+		&model.Limits.RateLimit, &model.Limits.RateBurst, &model.Limits.MaxConns, &model.Limits.DailyQuota, &model.Limits.MonthlyQuota, &model.Status,
+		&model.Exit.IP, &model.Exit.Country, &model.Exit.ASN, &model.Exit.ASOrg, &model.Exit.Anonymity, &tags, &model.FailedChecks, &model.LastCheckAt, &model.CreatedAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("proxy with username %s not found", username)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to record check result: %w", err)
+	}
+	model.Tags = splitTags(tags)
+
+	return &model, nil
+}
+
+// SetLimits stores the limits of a router user, whether it is a proxy or a pool credential.
+func (r *SQLiteRepository) SetLimits(ctx context.Context, username string, limits Limits) error {
+	for _, table := range []string{"proxies", "pools"} {
+		result, err := r.q.ExecContext(ctx,
+			fmt.Sprintf("UPDATE %s SET rate_limit = ?, rate_burst = ?, max_conns = ?, daily_quota = ?, monthly_quota = ? WHERE username = ?", table),
+			limits.RateLimit, limits.RateBurst, limits.MaxConns, limits.DailyQuota, limits.MonthlyQuota, username,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to set limits: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+
+		if rowsAffected > 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("user %s not found", username)
+}
+
+// SetPassword changes the password of a router user, whether it is a proxy or a pool credential.
+// The password must be hashed already, see HashPassword.
+func (r *SQLiteRepository) SetPassword(ctx context.Context, username, hash string) error {
+	if err := requireHash(username, hash); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"proxies", "pools"} {
+		result, err := r.q.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET password = ? WHERE username = ?", table), hash, username)
+		if err != nil {
+			return fmt.Errorf("failed to set password: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+
+		if rowsAffected > 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("user %s not found", username)
+}
+
+func (r *SQLiteRepository) SetStatus(ctx context.Context, username, status string) error {
+	result, err := r.q.ExecContext(ctx, "UPDATE proxies SET status = ? WHERE username = ?", status, username)
+	if err != nil {
+		return fmt.Errorf("failed to set status: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("proxy with username %s not found", username)
+	}
+
+	return nil
+}
+
+func (r *SQLiteRepository) SetExitInfo(ctx context.Context, username string, info ExitInfo) error {
+	result, err := r.q.ExecContext(ctx,
+		"UPDATE proxies SET exit_ip = ?, country = ?, asn = ?, as_org = ?, anonymity = ? WHERE username = ?",
+		info.IP, info.Country, info.ASN, info.ASOrg, info.Anonymity, username,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set exit info: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("proxy with username %s not found", username)
+	}
+
+	return nil
+}
+
+func (r *SQLiteRepository) SetTags(ctx context.Context, username string, tags []string) error {
+	result, err := r.q.ExecContext(ctx, "UPDATE proxies SET tags = ? WHERE username = ?", joinTags(tags), username)
+	if err != nil {
+		return fmt.Errorf("failed to set tags: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("proxy with username %s not found", username)
+	}
+
+	return nil
+}
+
+// Tags are stored comma separated, the router keeps commas out of them.
+func joinTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, ",")
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
 func (r *SQLiteRepository) Close() error {
 	return r.db.Close()
 }
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLiteConcurrentTransactions(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "proxies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	if _, err := repo.Create(ctx, &ProxyModel{Username: "user", Password: "secret", Target: "127.0.0.1:8080"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both transactions read before either writes, unless the first one to
+	// begin holds the other back until it commits.
+	var wg, read sync.WaitGroup
+	read.Add(2)
+	bothRead := make(chan struct{})
+	go func() {
+		read.Wait()
+		close(bothRead)
+	}()
+
+	errs := make(chan error, 2)
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- repo.WithTx(ctx, func(tx IProxyStore) error {
+				if _, err := tx.FindByUsername(ctx, "user"); err != nil {
+					return err
+				}
+				read.Done()
+				select {
+				case <-bothRead:
+				case <-time.After(200 * time.Millisecond):
+				}
+				return tx.SetTags(ctx, "user", []string{fmt.Sprint(i)})
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent transaction failed: %v", err)
+		}
+	}
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	tests := map[string]string{
+		"proxies.db":                        "proxies.db?_busy_timeout=5000&_txlock=immediate",
+		"file:proxies.db?cache=shared":      "file:proxies.db?cache=shared&_busy_timeout=5000&_txlock=immediate",
+		"proxies.db?_busy_timeout=100":      "proxies.db?_busy_timeout=100&_txlock=immediate",
+		"proxies.db?_txlock=exclusive&_x=1": "proxies.db?_txlock=exclusive&_x=1&_busy_timeout=5000",
+	}
+	for path, want := range tests {
+		if got := sqliteDSN(path); got != want {
+			t.Errorf("sqliteDSN(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
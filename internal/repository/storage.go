@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Storage drivers.
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMemory   = "memory"
+)
+
+var Drivers = []string{DriverSQLite, DriverPostgres, DriverMemory}
+
+var ErrUnknownDriver = errors.New("unknown storage driver")
+
+// New opens the storage of driver and applies pending migrations. dsn is the
+// database file of sqlite and the connection string of postgres, memory
+// ignores it.
+func New(driver, dsn string) (IProxyRepository, error) {
+	repo, err := Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if migrator, ok := repo.(Migrator); ok {
+		if _, err := migrator.Migrate(); err != nil {
+			repo.Close()
+			return nil, err
+		}
+	}
+
+	return repo, nil
+}
+
+// Open opens the storage of driver without migrating it.
+func Open(driver, dsn string) (IProxyRepository, error) {
+	switch driver {
+	case DriverSQLite:
+		repo, err := OpenSQLiteRepository(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return repo, nil
+	case DriverPostgres:
+		repo, err := OpenPostgresRepository(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return repo, nil
+	case DriverMemory:
+		return NewMemoryRepository(), nil
+	}
+	return nil, fmt.Errorf("%w: %q, use sqlite, postgres or memory", ErrUnknownDriver, driver)
+}
@@ -0,0 +1,16 @@
+-- The schema and data of a database created by the first release, before
+-- schema_migrations existed.
+CREATE TABLE IF NOT EXISTS proxies (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	target TEXT NOT NULL,
+	failed_checks INTEGER DEFAULT 0,
+	last_check_at DATETIME DEFAULT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_username ON proxies(username);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_target ON proxies(target);
+
+INSERT INTO proxies (username, password, target, failed_checks) VALUES ('alice', 'secret', '10.0.0.1:3128', 2);
+INSERT INTO proxies (username, password, target) VALUES ('bob', 'hunter2', '10.0.0.2:3128');
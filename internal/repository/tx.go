@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// querier runs statements on the database, or inside the transaction of a
+// repository handed out by WithTx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// inTx runs fn in a transaction of db that is committed when fn succeeds and
+// rolled back otherwise. When q already is a transaction fn joins it, so
+// that methods made of several statements stay atomic inside WithTx.
+func inTx(ctx context.Context, db *sql.DB, q querier, fn func(tx querier) error) error {
+	if tx, ok := q.(*sql.Tx); ok {
+		return fn(tx)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
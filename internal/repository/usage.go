@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+)
+
+// UsageModel is the traffic a user moved through one upstream on one UTC day
+// (YYYY-MM-DD). BytesUp is sent by the client, BytesDown received by it.
+type UsageModel struct {
+	Username  string
+	Upstream  string
+	Day       string
+	BytesUp   int64
+	BytesDown int64
+}
+
+// AddUsage adds the byte counts of records to the stored totals.
+func (r *SQLiteRepository) AddUsage(ctx context.Context, records []*UsageModel) error {
+	return inTx(ctx, r.db, r.q, func(tx querier) error {
+		stmt, err := tx.PrepareContext(ctx,
+			`INSERT INTO usage (username, upstream, day, bytes_up, bytes_down) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (username, upstream, day) DO UPDATE SET
+			bytes_up = bytes_up + excluded.bytes_up, bytes_down = bytes_down + excluded.bytes_down`,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to prepare usage insert: %w", err)
+		}
+		defer stmt.Close()
+
+		for _, record := range records {
+			if _, err := stmt.ExecContext(ctx, record.Username, record.Upstream, record.Day, record.BytesUp, record.BytesDown); err != nil {
+				return fmt.Errorf("failed to add usage: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// FindUsage returns the usage recorded on or after the day since (YYYY-MM-DD).
+func (r *SQLiteRepository) FindUsage(ctx context.Context, since string) ([]*UsageModel, error) {
+	rows, err := r.q.QueryContext(ctx,
+		"SELECT username, upstream, day, bytes_up, bytes_down FROM usage WHERE day >= ? ORDER BY day, username, upstream",
+		since,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	var models []*UsageModel
+	for rows.Next() {
+		var model UsageModel
+		if err := rows.Scan(&model.Username, &model.Upstream, &model.Day, &model.BytesUp, &model.BytesDown); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		models = append(models, &model)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return models, nil
+}
@@ -0,0 +1,103 @@
+package router
+
+import (
+	"crypto/sha256"
+	"runtime"
+	"sync"
+
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+const credentialCacheSize = 4096
+
+// dummyHash is verified for unknown users, so that they take as long to
+// refuse as wrong passwords.
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := repository.HashPassword("")
+	return hash
+})
+
+// credentialCache remembers the passwords verified against stored hashes, so
+// that hashing is paid once per client rather than once per connection. At
+// most one hash is computed per CPU at a time, each takes megabytes of memory.
+type credentialCache struct {
+	mu      sync.Mutex
+	entries map[credentialKey]string
+	hashing chan struct{}
+}
+
+// credentialKey is a verified password of a user, entries map it to the
+// stored hash it was verified against.
+type credentialKey struct {
+	username string
+	digest   [sha256.Size]byte
+}
+
+func newCredentialCache() *credentialCache {
+	return &credentialCache{
+		entries: make(map[credentialKey]string),
+		hashing: make(chan struct{}, runtime.GOMAXPROCS(0)),
+	}
+}
+
+// verify reports whether password matches stored, the password of username.
+// Only passwords verified before skip hashing, a wrong one costs a hash like
+// the password of an unknown user, so refusals do not tell users apart.
+func (c *credentialCache) verify(username, stored, password string) bool {
+	key := credentialKey{username: username, digest: sha256.Sum256([]byte(password))}
+
+	c.mu.Lock()
+	verified, exists := c.entries[key]
+	c.mu.Unlock()
+	if exists && verified == stored {
+		return true
+	}
+
+	if !c.hash(stored, password) {
+		return false
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= credentialCacheSize {
+		clear(c.entries)
+	}
+	c.entries[key] = stored
+	c.mu.Unlock()
+
+	return true
+}
+
+// refuse spends the time of a verification, for users that do not exist.
+func (c *credentialCache) refuse(password string) {
+	c.hash(dummyHash(), password)
+}
+
+func (c *credentialCache) hash(stored, password string) bool {
+	c.hashing <- struct{}{}
+	defer func() { <-c.hashing }()
+
+	return repository.VerifyPassword(stored, password)
+}
+
+// authenticate checks the password of creds against the stored user they
+// log in as.
+func (pr *ProxyRouter) authenticate(creds Credentials) error {
+	pr.mu.RLock()
+	username := pr.baseUsername(creds)
+	stored, exists := "", false
+	if config, ok := pr.cache[username]; ok {
+		stored, exists = config.Password, true
+	} else if pool, ok := pr.pools[username]; ok {
+		stored, exists = pool.Password, true
+	}
+	pr.mu.RUnlock()
+
+	if !exists {
+		pr.credentials.refuse(creds.Password)
+		return ErrInvalidCredentials
+	}
+	if !pr.credentials.verify(username, stored, creds.Password) {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
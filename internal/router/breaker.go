@@ -0,0 +1,104 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states of an upstream.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+const DefaultBreakerCooldown = 30 * time.Second
+
+// WithBreaker takes an upstream out of rotation once threshold connections in
+// a row failed to use it. After cooldown one connection is let through as a
+// probe: the circuit closes when it succeeds and opens again when it fails.
+// A threshold of 0 disables the breaker.
+func WithBreaker(threshold int, cooldown time.Duration) Option {
+	return func(pr *ProxyRouter) {
+		pr.breakerThreshold = threshold
+		if cooldown > 0 {
+			pr.breakerCooldown = cooldown
+		}
+	}
+}
+
+// breaker tracks the outcome of live connections to an upstream. changedAt is
+// when the circuit opened or the last half-open probe was let through.
+type breaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	changedAt time.Time
+}
+
+// available reports whether a connection may be tried: the circuit is closed,
+// or the cooldown since it opened or since the last probe passed.
+func (b *breaker) available(now time.Time, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state == CircuitClosed || now.Sub(b.changedAt) >= cooldown
+}
+
+// take records that a connection is tried. Once the cooldown passed, that
+// connection is the half-open probe and others wait for its outcome.
+func (b *breaker) take(now time.Time, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != CircuitClosed && now.Sub(b.changedAt) >= cooldown {
+		b.state = CircuitHalfOpen
+		b.changedAt = now
+	}
+}
+
+// record counts the outcome of a connection.
+func (b *breaker) record(success bool, now time.Time, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == CircuitHalfOpen || (b.state == CircuitClosed && b.failures >= threshold) {
+		b.state = CircuitOpen
+		b.changedAt = now
+	}
+}
+
+// available reports whether the circuit of config lets a connection through.
+func (pr *ProxyRouter) available(config *ProxyConfig) bool {
+	if pr.breakerThreshold <= 0 || config.state == nil {
+		return true
+	}
+	return config.state.breaker.available(time.Now(), pr.breakerCooldown)
+}
+
+// take records that a connection to config is about to be tried.
+func (pr *ProxyRouter) take(config *ProxyConfig) *ProxyConfig {
+	if pr.breakerThreshold > 0 && config.state != nil {
+		config.state.breaker.take(time.Now(), pr.breakerCooldown)
+	}
+	return config
+}
+
+// ReportSuccess records that live traffic reached the upstream owned by
+// username, closing its circuit.
+func (pr *ProxyRouter) ReportSuccess(username string) {
+	pr.mu.RLock()
+	config, exists := pr.cache[username]
+	pr.mu.RUnlock()
+
+	if exists && config.state != nil {
+		config.state.breaker.record(true, time.Now(), pr.breakerThreshold)
+	}
+}
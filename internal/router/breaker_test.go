@@ -0,0 +1,87 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+	repo, err := repository.NewSQLiteRepository(filepath.Join(t.TempDir(), "proxies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	cooldown := 50 * time.Millisecond
+	pr := NewProxyRouter(repo, WithBreaker(2, cooldown))
+	if err := pr.AddProxy(ctx, &ProxyConfig{Username: "user", Password: "pass", Target: "127.0.0.1:3000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func() error {
+		_, err := pr.Resolve("user", "pass")
+		return err
+	}
+
+	pr.ReportFailure("user")
+	if err := resolve(); err != nil {
+		t.Fatalf("expected closed circuit below the threshold, got %v", err)
+	}
+
+	pr.ReportFailure("user")
+	if err := resolve(); !errors.Is(err, ErrNoUpstream) {
+		t.Fatalf("expected open circuit, got %v", err)
+	}
+
+	time.Sleep(cooldown)
+	if err := resolve(); err != nil {
+		t.Fatalf("expected a half-open probe, got %v", err)
+	}
+	if err := resolve(); !errors.Is(err, ErrNoUpstream) {
+		t.Fatalf("expected only one probe, got %v", err)
+	}
+
+	// A failed probe opens the circuit again at once.
+	pr.ReportFailure("user")
+	time.Sleep(cooldown)
+	if err := resolve(); err != nil {
+		t.Fatalf("expected another probe, got %v", err)
+	}
+
+	pr.ReportSuccess("user")
+	for i := 0; i < 3; i++ {
+		if err := resolve(); err != nil {
+			t.Fatalf("expected closed circuit, got %v", err)
+		}
+	}
+}
+
+func TestPoolSkipsOpenCircuit(t *testing.T) {
+	pr := newTestPool(t, StrategyRoundRobin, 2)
+	pr.breakerThreshold = 1
+
+	pr.ReportFailure("member0")
+	// member1 is unhealthy too, but its circuit is closed.
+	pr.SetHealth("member1", false, 0)
+
+	for i := 0; i < 4; i++ {
+		config, err := pr.Resolve("pooluser", "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Username != "member1" {
+			t.Fatalf("picked %s with an open circuit", config.Username)
+		}
+	}
+
+	pr.ReportFailure("member1")
+	if _, err := pr.Resolve("pooluser", "pass"); !errors.Is(err, ErrNoUpstream) {
+		t.Fatalf("expected ErrNoUpstream, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+// UserLimits returns the stored username creds log in as, with its limits.
+// Session and other username parameters share the limits of the base user.
+func (pr *ProxyRouter) UserLimits(creds Credentials) (string, repository.Limits) {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+
+	username := pr.baseUsername(creds)
+	if config, exists := pr.cache[username]; exists {
+		return username, config.Limits
+	}
+	if pool, exists := pr.pools[username]; exists {
+		return username, pool.Limits
+	}
+	return username, repository.Limits{}
+}
+
+// GetLimits returns the limits of a proxy or pool user.
+func (pr *ProxyRouter) GetLimits(username string) (repository.Limits, error) {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+
+	if config, exists := pr.cache[username]; exists {
+		return config.Limits, nil
+	}
+	if pool, exists := pr.pools[username]; exists {
+		return pool.Limits, nil
+	}
+	return repository.Limits{}, fmt.Errorf("%w: username %s", ErrProxyNotFound, username)
+}
+
+// SetLimits replaces the limits of a proxy or pool user. Zero values fall back
+// to the global defaults.
+func (pr *ProxyRouter) SetLimits(ctx context.Context, username string, limits repository.Limits) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if !pr.usernameTaken(username) {
+		return fmt.Errorf("%w: username %s", ErrProxyNotFound, username)
+	}
+
+	if err := pr.repo.SetLimits(ctx, username, limits); err != nil {
+		return err
+	}
+
+	if config, exists := pr.cache[username]; exists {
+		updated := *config
+		updated.Limits = limits
+		pr.cache[username] = &updated
+	}
+	if pool, exists := pr.pools[username]; exists {
+		pool.Limits = limits
+	}
+
+	return nil
+}
@@ -0,0 +1,315 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyRandom           = "random"
+	StrategyLeastConnections = "least_connections"
+	StrategyLowestLatency    = "lowest_latency"
+)
+
+var (
+	ErrPoolNotFound    = errors.New("pool not found")
+	ErrInvalidStrategy = errors.New("invalid pool strategy")
+)
+
+// Strategies lists the supported pool balancing strategies.
+var Strategies = []string{StrategyRoundRobin, StrategyRandom, StrategyLeastConnections, StrategyLowestLatency}
+
+// PoolConfig binds a router credential to a named group of upstream proxies.
+// Members are the usernames of the proxies in the group.
+type PoolConfig struct {
+	ID       int64
+	Name     string
+	Username string
+	Password string
+	Strategy string
+	Limits   repository.Limits
+	Members  []string
+
+	next atomic.Uint64
+}
+
+func newPoolConfig(model *repository.PoolModel) *PoolConfig {
+	return &PoolConfig{
+		ID:       model.ID,
+		Name:     model.Name,
+		Username: model.Username,
+		Password: model.Password,
+		Strategy: model.Strategy,
+		Limits:   model.Limits,
+		Members:  slices.Clone(model.Members),
+	}
+}
+
+func (p *PoolConfig) clone() *PoolConfig {
+	return &PoolConfig{
+		ID:       p.ID,
+		Name:     p.Name,
+		Username: p.Username,
+		Password: p.Password,
+		Strategy: p.Strategy,
+		Limits:   p.Limits,
+		Members:  slices.Clone(p.Members),
+	}
+}
+
+// upstreamState is the live state of an upstream shared by all copies of its ProxyConfig.
+type upstreamState struct {
+	healthy atomic.Bool
+	latency atomic.Int64
+	active  atomic.Int64
+	breaker breaker
+}
+
+func newUpstreamState(healthy bool) *upstreamState {
+	s := &upstreamState{}
+	s.healthy.Store(healthy)
+	s.breaker.state = CircuitClosed
+	return s
+}
+
+// Acquire marks a connection to the upstream as active for least-connections balancing.
+// The returned function must be called once the connection is closed.
+func (pr *ProxyRouter) Acquire(config *ProxyConfig) func() {
+	if config.state == nil {
+		return func() {}
+	}
+
+	config.state.active.Add(1)
+	return func() {
+		config.state.active.Add(-1)
+	}
+}
+
+// ReportFailure marks the upstream owned by username as unhealthy after live
+// traffic failed to use it, and counts the failure towards opening its
+// circuit. Nothing is persisted, the next successful check restores it.
+func (pr *ProxyRouter) ReportFailure(username string) {
+	pr.mu.RLock()
+	config, exists := pr.cache[username]
+	pr.mu.RUnlock()
+
+	if exists && config.state != nil {
+		config.state.healthy.Store(false)
+		if pr.breakerThreshold > 0 {
+			config.state.breaker.record(false, time.Now(), pr.breakerThreshold)
+		}
+	}
+}
+
+// SetHealth records the outcome of a health check of the upstream owned by
+// username. A passed check also closes its circuit.
+func (pr *ProxyRouter) SetHealth(username string, healthy bool, latency time.Duration) {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+
+	config, exists := pr.cache[username]
+	if !exists || config.state == nil {
+		return
+	}
+
+	config.state.healthy.Store(healthy)
+	if healthy {
+		config.state.latency.Store(int64(latency))
+		config.state.breaker.record(true, time.Now(), pr.breakerThreshold)
+	}
+}
+
+// pickMember selects a pool member according to the pool strategy. Members in
+// exclude, members that are not routable or do not match the selector and
+// members with an open circuit are never picked, unhealthy ones are skipped
+// unless none of the rest is healthy. Callers must hold pr.mu.
+func (pr *ProxyRouter) pickMember(pool *PoolConfig, exclude []string, selector Selector) (*ProxyConfig, error) {
+	members := make([]*ProxyConfig, 0, len(pool.Members))
+	healthy := make([]*ProxyConfig, 0, len(pool.Members))
+	matched := 0
+	for _, username := range pool.Members {
+		config, exists := pr.cache[username]
+		if !exists || !config.Routable() || !selector.Matches(config) {
+			continue
+		}
+		matched++
+		if slices.Contains(exclude, username) || !pr.available(config) {
+			continue
+		}
+		members = append(members, config)
+		if config.state == nil || config.state.healthy.Load() {
+			healthy = append(healthy, config)
+		}
+	}
+
+	if matched == 0 && !selector.IsZero() {
+		return nil, fmt.Errorf("%w: %s in pool %s", ErrNoMatch, selector, pool.Name)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("%w: pool %s has no members left", ErrNoUpstream, pool.Name)
+	}
+	if len(healthy) > 0 {
+		members = healthy
+	}
+
+	return pr.take(pickByStrategy(pool, members)), nil
+}
+
+func pickByStrategy(pool *PoolConfig, members []*ProxyConfig) *ProxyConfig {
+	switch pool.Strategy {
+	case StrategyRandom:
+		return members[rand.IntN(len(members))]
+	case StrategyLeastConnections:
+		return minBy(members, func(c *ProxyConfig) int64 {
+			if c.state == nil {
+				return 0
+			}
+			return c.state.active.Load()
+		})
+	case StrategyLowestLatency:
+		return minBy(members, func(c *ProxyConfig) int64 {
+			if c.state == nil || c.state.latency.Load() == 0 {
+				return math.MaxInt64
+			}
+			return c.state.latency.Load()
+		})
+	default:
+		return members[(pool.next.Add(1)-1)%uint64(len(members))]
+	}
+}
+
+func minBy(members []*ProxyConfig, value func(*ProxyConfig) int64) *ProxyConfig {
+	best := members[0]
+	bestValue := value(best)
+	for _, config := range members[1:] {
+		if v := value(config); v < bestValue {
+			best, bestValue = config, v
+		}
+	}
+	return best
+}
+
+func (pr *ProxyRouter) usernameTaken(username string) bool {
+	_, proxyExists := pr.cache[username]
+	_, poolExists := pr.pools[username]
+	return proxyExists || poolExists
+}
+
+func (pr *ProxyRouter) findPool(name string) (*PoolConfig, bool) {
+	for _, pool := range pr.pools {
+		if pool.Name == name {
+			return pool, true
+		}
+	}
+	return nil, false
+}
+
+func (pr *ProxyRouter) AddPool(ctx context.Context, pool *PoolConfig) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pool.Strategy == "" {
+		pool.Strategy = StrategyRoundRobin
+	}
+	if !slices.Contains(Strategies, pool.Strategy) {
+		return fmt.Errorf("%w: %s", ErrInvalidStrategy, pool.Strategy)
+	}
+
+	if pr.usernameTaken(pool.Username) {
+		return fmt.Errorf("%w: username %s", ErrProxyExists, pool.Username)
+	}
+
+	model, err := pr.repo.CreatePool(ctx, &repository.PoolModel{
+		Name:     pool.Name,
+		Username: pool.Username,
+		Password: pool.Password,
+		Strategy: pool.Strategy,
+		Limits:   pool.Limits,
+	})
+	if err != nil {
+		return err
+	}
+
+	pr.pools[model.Username] = newPoolConfig(model)
+
+	return nil
+}
+
+func (pr *ProxyRouter) RemovePool(ctx context.Context, name string) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pool, exists := pr.findPool(name)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrPoolNotFound, name)
+	}
+
+	if err := pr.repo.DeletePool(ctx, name); err != nil {
+		return err
+	}
+
+	delete(pr.pools, pool.Username)
+	return nil
+}
+
+func (pr *ProxyRouter) AddPoolMember(ctx context.Context, name, proxyUsername string) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pool, exists := pr.findPool(name)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrPoolNotFound, name)
+	}
+	if _, exists := pr.cache[proxyUsername]; !exists {
+		return fmt.Errorf("%w: username %s", ErrProxyNotFound, proxyUsername)
+	}
+	if slices.Contains(pool.Members, proxyUsername) {
+		return nil
+	}
+
+	if err := pr.repo.AddPoolMember(ctx, name, proxyUsername); err != nil {
+		return err
+	}
+
+	pool.Members = append(pool.Members, proxyUsername)
+	return nil
+}
+
+func (pr *ProxyRouter) RemovePoolMember(ctx context.Context, name, proxyUsername string) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pool, exists := pr.findPool(name)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrPoolNotFound, name)
+	}
+
+	if err := pr.repo.RemovePoolMember(ctx, name, proxyUsername); err != nil {
+		return err
+	}
+
+	pool.Members = slices.DeleteFunc(pool.Members, func(member string) bool {
+		return member == proxyUsername
+	})
+	return nil
+}
+
+func (pr *ProxyRouter) GetAllPools() []*PoolConfig {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+
+	result := make([]*PoolConfig, 0, len(pr.pools))
+	for _, pool := range pr.pools {
+		result = append(result, pool.clone())
+	}
+	return result
+}
@@ -0,0 +1,177 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+func newTestRouter(t *testing.T) *ProxyRouter {
+	t.Helper()
+
+	repo, err := repository.NewSQLiteRepository(filepath.Join(t.TempDir(), "proxies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	return NewProxyRouter(repo)
+}
+
+func newTestPool(t *testing.T, strategy string, members int) *ProxyRouter {
+	ctx := context.Background()
+	t.Helper()
+
+	pr := newTestRouter(t)
+	if err := pr.AddPool(ctx, &PoolConfig{Name: "pool", Username: "pooluser", Password: "pass", Strategy: strategy}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < members; i++ {
+		username := fmt.Sprintf("member%d", i)
+		if err := pr.AddProxy(ctx, &ProxyConfig{Username: username, Password: "x", Target: fmt.Sprintf("127.0.0.1:%d", 3000+i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pr.AddPoolMember(ctx, "pool", username); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return pr
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pr := newTestPool(t, StrategyRoundRobin, 3)
+
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		config, err := pr.Resolve("pooluser", "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[config.Username]++
+	}
+
+	for username, count := range seen {
+		if count != 2 {
+			t.Fatalf("member %s picked %d times, want 2", username, count)
+		}
+	}
+}
+
+func TestPoolSkipsUnhealthy(t *testing.T) {
+	pr := newTestPool(t, StrategyRoundRobin, 2)
+	pr.SetHealth("member0", false, 0)
+
+	for i := 0; i < 4; i++ {
+		config, err := pr.Resolve("pooluser", "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Username != "member1" {
+			t.Fatalf("picked unhealthy member %s", config.Username)
+		}
+	}
+}
+
+func TestPoolSkipsQuarantined(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestPool(t, StrategyRoundRobin, 2)
+	if err := pr.SetStatus(ctx, "member0", repository.StatusQuarantined); err != nil {
+		t.Fatal(err)
+	}
+	// Unlike an unhealthy member, a quarantined one is not a fallback.
+	pr.SetHealth("member1", false, 0)
+
+	for i := 0; i < 4; i++ {
+		config, err := pr.Resolve("pooluser", "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Username != "member1" {
+			t.Fatalf("picked quarantined member %s", config.Username)
+		}
+	}
+
+	if err := pr.SetStatus(ctx, "member1", repository.StatusDisabled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Resolve("pooluser", "pass"); !errors.Is(err, ErrNoUpstream) {
+		t.Fatalf("expected no upstream, got %v", err)
+	}
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	pr := newTestPool(t, StrategyLeastConnections, 2)
+
+	first, err := pr.Resolve("pooluser", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := pr.Acquire(first)
+
+	second, err := pr.Resolve("pooluser", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Username == first.Username {
+		t.Fatal("least connections picked the busy member")
+	}
+	release()
+}
+
+func TestPoolLowestLatency(t *testing.T) {
+	pr := newTestPool(t, StrategyLowestLatency, 3)
+	pr.SetHealth("member0", true, 300*time.Millisecond)
+	pr.SetHealth("member1", true, 100*time.Millisecond)
+	pr.SetHealth("member2", true, 200*time.Millisecond)
+
+	config, err := pr.Resolve("pooluser", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "member1" {
+		t.Fatalf("picked %s, want member1", config.Username)
+	}
+}
+
+func TestPoolErrors(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestPool(t, StrategyRandom, 0)
+
+	if _, err := pr.Resolve("pooluser", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := pr.Resolve("pooluser", "pass"); !errors.Is(err, ErrNoUpstream) {
+		t.Fatalf("expected ErrNoUpstream, got %v", err)
+	}
+	if err := pr.AddProxy(ctx, &ProxyConfig{Username: "pooluser", Password: "x", Target: "127.0.0.1:1"}); !errors.Is(err, ErrProxyExists) {
+		t.Fatalf("expected ErrProxyExists, got %v", err)
+	}
+	if err := pr.AddPool(ctx, &PoolConfig{Name: "other", Username: "other", Password: "x", Strategy: "fastest"}); !errors.Is(err, ErrInvalidStrategy) {
+		t.Fatalf("expected ErrInvalidStrategy, got %v", err)
+	}
+}
+
+func TestPoolReload(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestPool(t, StrategyRoundRobin, 2)
+
+	reloaded := NewProxyRouter(pr.repo)
+	pools := reloaded.GetAllPools()
+	if len(pools) != 1 || len(pools[0].Members) != 2 {
+		t.Fatalf("unexpected pools after reload: %+v", pools)
+	}
+
+	if err := reloaded.RemoveProxy(ctx, "member0"); err != nil {
+		t.Fatal(err)
+	}
+	if pools := reloaded.GetAllPools(); len(pools[0].Members) != 1 {
+		t.Fatalf("removed proxy still a member: %+v", pools[0].Members)
+	}
+}
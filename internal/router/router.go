@@ -1,45 +1,141 @@
 package router
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/upstream"
+)
+
+var (
+	ErrProxyNotFound = errors.New("proxy not found")
+	ErrProxyExists   = errors.New("proxy already exists")
+	ErrInvalidTarget = errors.New("invalid proxy target")
+
+	ErrInvalidStatus = errors.New("invalid proxy status")
+
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrNoUpstream         = errors.New("no upstream available")
 )
 
 type IProxyROuter interface {
-	AddProxy(username, password, target string)
+	AddProxy(config *ProxyConfig) error
+	UpdateProxy(config *ProxyConfig) error
 	GetProxy(username, password string) (*ProxyConfig, bool)
 	RemoveProxy(username string)
 	ListProxies() map[string]string
 }
 
 type ProxyConfig struct {
-	ID       int64
-	Username string
-	Password string
-	Target   string
+	ID               int64
+	Username         string
+	Password         string
+	Target           string
+	UpstreamUsername string
+	UpstreamPassword string
+	Limits           repository.Limits
+	Status           string
+	Exit             repository.ExitInfo
+	Tags             []string
+
+	state *upstreamState
+}
+
+// sameAs reports whether c and other hold the same stored fields and state.
+func (c *ProxyConfig) sameAs(other *ProxyConfig) bool {
+	return c.ID == other.ID &&
+		c.Username == other.Username &&
+		c.Password == other.Password &&
+		c.Target == other.Target &&
+		c.UpstreamUsername == other.UpstreamUsername &&
+		c.UpstreamPassword == other.UpstreamPassword &&
+		c.Limits == other.Limits &&
+		c.Status == other.Status &&
+		c.Exit == other.Exit &&
+		slices.Equal(c.Tags, other.Tags) &&
+		c.state == other.state
+}
+
+// Routable reports whether clients may be routed to the upstream.
+// Quarantined and disabled proxies keep their credentials but carry no traffic.
+func (c *ProxyConfig) Routable() bool {
+	return c.Status != repository.StatusQuarantined && c.Status != repository.StatusDisabled
+}
+
+// Upstream returns the parsed upstream proxy with its stored credentials applied.
+func (c *ProxyConfig) Upstream() (*upstream.Proxy, error) {
+	return upstream.ParseWithAuth(c.Target, c.UpstreamUsername, c.UpstreamPassword)
+}
+
+func newProxyConfig(model *repository.ProxyModel) *ProxyConfig {
+	return &ProxyConfig{
+		ID:               model.ID,
+		Username:         model.Username,
+		Password:         model.Password,
+		Target:           model.Target,
+		UpstreamUsername: model.UpstreamUsername,
+		UpstreamPassword: model.UpstreamPassword,
+		Limits:           model.Limits,
+		Status:           model.Status,
+		Exit:             model.Exit,
+		Tags:             model.Tags,
+		state:            newUpstreamState(model.FailedChecks == 0),
+	}
 }
 
 type ProxyRouter struct {
 	repo  repository.IProxyRepository
 	cache map[string]*ProxyConfig
+	pools map[string]*PoolConfig
 	mu    sync.RWMutex
+
+	sessionTTL time.Duration
+	sessions   map[string]*session
+	sessionsMu sync.Mutex
+	lastSweep  time.Time
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	credentials *credentialCache
 }
 
-func NewProxyRouter(repo repository.IProxyRepository) *ProxyRouter {
+func NewProxyRouter(repo repository.IProxyRepository, opts ...Option) *ProxyRouter {
 	pr := &ProxyRouter{
-		repo:  repo,
-		cache: make(map[string]*ProxyConfig),
+		repo:       repo,
+		cache:      make(map[string]*ProxyConfig),
+		pools:      make(map[string]*PoolConfig),
+		sessionTTL: DefaultSessionTTL,
+		sessions:   make(map[string]*session),
+
+		breakerCooldown: DefaultBreakerCooldown,
+		credentials:     newCredentialCache(),
+	}
+
+	for _, opt := range opts {
+		opt(pr)
 	}
 
-	pr.loadCache()
+	pr.Reload(context.Background())
 
 	return pr
 }
 
-func (pr *ProxyRouter) loadCache() error {
-	models, err := pr.repo.FindAll()
+// Reload syncs the cache with storage, picking up changes made by other
+// processes such as the import command, or by components that write to the
+// repository directly. Unchanged proxies keep their live health state.
+func (pr *ProxyRouter) Reload(ctx context.Context) error {
+	models, err := pr.repo.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	pools, err := pr.repo.FindAllPools(ctx)
 	if err != nil {
 		return err
 	}
@@ -47,84 +143,229 @@ func (pr *ProxyRouter) loadCache() error {
 	pr.mu.Lock()
 	defer pr.mu.Unlock()
 
+	cache := make(map[string]*ProxyConfig, len(models))
 	for _, model := range models {
-		pr.cache[model.Username] = &ProxyConfig{
-			ID:       model.ID,
-			Username: model.Username,
-			Password: model.Password,
-			Target:   model.Target,
+		config := newProxyConfig(model)
+		if cached, exists := pr.cache[model.Username]; exists {
+			config.state = cached.state
+			if config.sameAs(cached) {
+				config = cached
+			}
 		}
+		cache[model.Username] = config
 	}
+	pr.cache = cache
+
+	loaded := make(map[string]*PoolConfig, len(pools))
+	for _, model := range pools {
+		pool, exists := pr.pools[model.Username]
+		if !exists {
+			loaded[model.Username] = newPoolConfig(model)
+			continue
+		}
+
+		// Pools are updated in place to keep their round-robin position.
+		pool.ID = model.ID
+		pool.Name = model.Name
+		pool.Password = model.Password
+		pool.Strategy = model.Strategy
+		pool.Limits = model.Limits
+		pool.Members = slices.Clone(model.Members)
+		loaded[model.Username] = pool
+	}
+	pr.pools = loaded
 
 	return nil
 }
 
-func (pr *ProxyRouter) AddProxy(username, password, target string) error {
+func (pr *ProxyRouter) AddProxy(ctx context.Context, config *ProxyConfig) error {
 	pr.mu.Lock()
 	defer pr.mu.Unlock()
 
-	if _, exists := pr.cache[username]; exists {
-		return fmt.Errorf("proxy with username %s already exists", username)
+	if pr.usernameTaken(config.Username) {
+		return fmt.Errorf("%w: username %s", ErrProxyExists, config.Username)
+	}
+
+	if _, err := config.Upstream(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTarget, err)
 	}
 
-	model, err := pr.repo.Create(username, password, target)
+	tags, err := NormalizeTags(config.Tags)
 	if err != nil {
 		return err
 	}
 
-	pr.cache[username] = &ProxyConfig{
-		ID:       model.ID,
-		Username: model.Username,
-		Password: model.Password,
-		Target:   model.Target,
+	model, err := pr.repo.Create(ctx, &repository.ProxyModel{
+		Username:         config.Username,
+		Password:         config.Password,
+		Target:           config.Target,
+		UpstreamUsername: config.UpstreamUsername,
+		UpstreamPassword: config.UpstreamPassword,
+		Limits:           config.Limits,
+		Tags:             tags,
+	})
+	if err != nil {
+		return err
 	}
 
+	pr.cache[config.Username] = newProxyConfig(model)
+
 	return nil
 }
 
-func (pr *ProxyRouter) UpdateProxy(username, password, target string) error {
+// UpdateProxy changes a proxy. An empty password keeps the stored one.
+func (pr *ProxyRouter) UpdateProxy(ctx context.Context, config *ProxyConfig) error {
+	if _, err := config.Upstream(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+
+	tags, err := NormalizeTags(config.Tags)
+	if err != nil {
+		return err
+	}
+
+	var hash string
+	if config.Password != "" {
+		if hash, err = repository.HashPassword(config.Password); err != nil {
+			return err
+		}
+	}
+
 	pr.mu.Lock()
 	defer pr.mu.Unlock()
 
-	config, exists := pr.cache[username]
+	cached, exists := pr.cache[config.Username]
 	if !exists {
-		return fmt.Errorf("proxy with username %s not found", username)
+		return fmt.Errorf("%w: username %s", ErrProxyNotFound, config.Username)
 	}
 
-	if err := pr.repo.Update(username, password, target); err != nil {
+	if err := pr.repo.Update(ctx, &repository.ProxyModel{
+		Username:         config.Username,
+		Password:         hash,
+		Target:           config.Target,
+		UpstreamUsername: config.UpstreamUsername,
+		UpstreamPassword: config.UpstreamPassword,
+		Tags:             tags,
+	}); err != nil {
 		return err
 	}
 
-	config.Password = password
-	config.Target = target
+	updated := *cached
+	if hash != "" {
+		updated.Password = hash
+	}
+	updated.Target = config.Target
+	updated.UpstreamUsername = config.UpstreamUsername
+	updated.UpstreamPassword = config.UpstreamPassword
+	updated.Tags = tags
+	pr.cache[config.Username] = &updated
 
 	return nil
 }
 
 func (pr *ProxyRouter) GetProxy(username, password string) (*ProxyConfig, bool) {
+	config, err := pr.Resolve(username, password)
+	return config, err == nil
+}
+
+// Resolve authenticates a client and returns the upstream to use for a new connection.
+func (pr *ProxyRouter) Resolve(username, password string) (*ProxyConfig, error) {
+	return pr.ResolveCredentials(ParseCredentials(username, password))
+}
+
+// ResolveCredentials is Resolve for already parsed credentials. Passwords are
+// checked against their stored hashes. A username stored verbatim wins over
+// its parsed form. Pool users get a member picked by
+// the pool strategy on every call, unless a session pins them to one. Only
+// upstreams matching the selector of creds are picked, ErrNoMatch is returned
+// when there is none.
+func (pr *ProxyRouter) ResolveCredentials(creds Credentials) (*ProxyConfig, error) {
+	if err := pr.authenticate(creds); err != nil {
+		return nil, err
+	}
+	return pr.resolve(creds, nil)
+}
+
+// Failover picks another upstream for creds once the upstreams in tried have
+// failed. Only pool users have alternatives, others get ErrNoUpstream.
+func (pr *ProxyRouter) Failover(creds Credentials, tried []string) (*ProxyConfig, error) {
+	if err := pr.authenticate(creds); err != nil {
+		return nil, err
+	}
+	return pr.resolve(creds, tried)
+}
+
+func (pr *ProxyRouter) resolve(creds Credentials, tried []string) (*ProxyConfig, error) {
 	pr.mu.RLock()
 	defer pr.mu.RUnlock()
 
-	config, exists := pr.cache[username]
-	if !exists || config.Password != password {
-		return nil, false
+	username := pr.baseUsername(creds)
+	if config, exists := pr.cache[username]; exists {
+		if !config.Routable() {
+			return nil, fmt.Errorf("%w: %s is %s", ErrNoUpstream, username, config.Status)
+		}
+		selector, err := creds.selector(username)
+		if err != nil {
+			return nil, err
+		}
+		if !selector.Matches(config) {
+			return nil, fmt.Errorf("%w: %s", ErrNoMatch, selector)
+		}
+		if len(tried) > 0 {
+			return nil, fmt.Errorf("%w: %s has a single upstream", ErrNoUpstream, username)
+		}
+		if !pr.available(config) {
+			return nil, fmt.Errorf("%w: circuit of %s is open", ErrNoUpstream, username)
+		}
+		return pr.take(config), nil
+	}
+
+	pool, exists := pr.pools[username]
+	if !exists {
+		return nil, ErrInvalidCredentials
 	}
-	return config, true
+
+	selector, err := creds.selector(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if username == creds.Raw || creds.Session == "" {
+		return pr.pickMember(pool, tried, selector)
+	}
+
+	return pr.sessionMember(pool, creds.Session, tried, selector)
+}
+
+// baseUsername returns the stored username creds log in as. Callers must hold pr.mu.
+func (pr *ProxyRouter) baseUsername(creds Credentials) string {
+	if _, exists := pr.cache[creds.Raw]; exists {
+		return creds.Raw
+	}
+	if _, exists := pr.pools[creds.Raw]; exists {
+		return creds.Raw
+	}
+	return creds.Username
 }
 
-func (pr *ProxyRouter) RemoveProxy(username string) error {
+func (pr *ProxyRouter) RemoveProxy(ctx context.Context, username string) error {
 	pr.mu.Lock()
 	defer pr.mu.Unlock()
 
 	if _, exists := pr.cache[username]; !exists {
-		return fmt.Errorf("proxy with username %s not found", username)
+		return fmt.Errorf("%w: username %s", ErrProxyNotFound, username)
 	}
 
-	if err := pr.repo.Delete(username); err != nil {
+	if err := pr.repo.Delete(ctx, username); err != nil {
 		return err
 	}
 
 	delete(pr.cache, username)
+	for _, pool := range pr.pools {
+		pool.Members = slices.DeleteFunc(pool.Members, func(member string) bool {
+			return member == username
+		})
+	}
 	return nil
 }
 
@@ -145,12 +386,139 @@ func (pr *ProxyRouter) GetAllProxies() ([]*ProxyConfig, error) {
 
 	result := make([]*ProxyConfig, 0, len(pr.cache))
 	for _, config := range pr.cache {
-		result = append(result, &ProxyConfig{
-			ID:       config.ID,
-			Username: config.Username,
-			Password: config.Password,
-			Target:   config.Target,
-		})
+		clone := *config
+		result = append(result, &clone)
 	}
 	return result, nil
 }
+
+// SetStatus changes the status of a proxy, e.g. to take it out of service.
+func (pr *ProxyRouter) SetStatus(ctx context.Context, username, status string) error {
+	if !slices.Contains(repository.Statuses, status) {
+		return fmt.Errorf("%w: %s", ErrInvalidStatus, status)
+	}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	cached, exists := pr.cache[username]
+	if !exists {
+		return fmt.Errorf("%w: username %s", ErrProxyNotFound, username)
+	}
+
+	if err := pr.repo.SetStatus(ctx, username, status); err != nil {
+		return err
+	}
+
+	updated := *cached
+	updated.Status = status
+	pr.cache[username] = &updated
+
+	return nil
+}
+
+// SetTags replaces the tags of a proxy.
+func (pr *ProxyRouter) SetTags(ctx context.Context, username string, tags []string) error {
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		return err
+	}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	cached, exists := pr.cache[username]
+	if !exists {
+		return fmt.Errorf("%w: username %s", ErrProxyNotFound, username)
+	}
+
+	if err := pr.repo.SetTags(ctx, username, tags); err != nil {
+		return err
+	}
+
+	updated := *cached
+	updated.Tags = tags
+	pr.cache[username] = &updated
+
+	return nil
+}
+
+// SetPassword changes the password of a proxy or pool user.
+func (pr *ProxyRouter) SetPassword(ctx context.Context, username, password string) error {
+	return pr.SetPasswords(ctx, map[string]string{username: password})
+}
+
+// SetPasswords changes the passwords of proxy and pool users, keyed by
+// username, in one transaction: either all of them change or none does.
+func (pr *ProxyRouter) SetPasswords(ctx context.Context, passwords map[string]string) error {
+	hashes := make(map[string]string, len(passwords))
+	for username, password := range passwords {
+		if password == "" {
+			return fmt.Errorf("%w: empty password", ErrInvalidCredentials)
+		}
+		hash, err := repository.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		hashes[username] = hash
+	}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for username := range hashes {
+		if !pr.usernameTaken(username) {
+			return fmt.Errorf("%w: username %s", ErrProxyNotFound, username)
+		}
+	}
+
+	err := pr.repo.WithTx(ctx, func(tx repository.IProxyStore) error {
+		for username, hash := range hashes {
+			if err := tx.SetPassword(ctx, username, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for username, hash := range hashes {
+		if config, exists := pr.cache[username]; exists {
+			updated := *config
+			updated.Password = hash
+			pr.cache[username] = &updated
+		}
+		if pool, exists := pr.pools[username]; exists {
+			pool.Password = hash
+		}
+	}
+
+	return nil
+}
+
+// Size returns the number of cached proxies and pools.
+func (pr *ProxyRouter) Size() (int, int) {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+
+	return len(pr.cache), len(pr.pools)
+}
+
+// FindProxy reads a proxy from storage, including its health-check state.
+func (pr *ProxyRouter) FindProxy(ctx context.Context, username string) (*repository.ProxyModel, error) {
+	model, err := pr.repo.FindByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if model == nil {
+		return nil, fmt.Errorf("%w: username %s", ErrProxyNotFound, username)
+	}
+	return model, nil
+}
+
+// FindProxies reads all proxies from storage, including their health-check state.
+func (pr *ProxyRouter) FindProxies(ctx context.Context) ([]*repository.ProxyModel, error) {
+	return pr.repo.FindAll(ctx)
+}
@@ -0,0 +1,144 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+func TestReloadPicksUpOutOfBandChanges(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "proxies.db")
+	open := func() *ProxyRouter {
+		repo, err := repository.NewSQLiteRepository(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { repo.Close() })
+		return NewProxyRouter(repo)
+	}
+
+	running, other := open(), open()
+	if err := other.AddProxy(ctx, &ProxyConfig{Username: "user", Password: "pass", Target: "127.0.0.1:3128"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := running.Resolve("user", "pass"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("proxy visible before reload: %v", err)
+	}
+
+	if err := running.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first, err := running.Resolve("user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged proxies keep their live state across reloads.
+	running.SetHealth("user", false, 0)
+	if err := running.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := running.Resolve("user", "pass"); config != first || config.state.healthy.Load() {
+		t.Fatal("reload replaced an unchanged proxy")
+	}
+
+	if err := other.UpdateProxy(ctx, &ProxyConfig{Username: "user", Password: "new", Target: "127.0.0.1:3129"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := running.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	config, err := running.Resolve("user", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Target != "127.0.0.1:3129" || first.Target != "127.0.0.1:3128" {
+		t.Fatalf("update not applied copy-on-write: %s, %s", config.Target, first.Target)
+	}
+
+	// An empty password keeps the stored one.
+	if err := other.UpdateProxy(ctx, &ProxyConfig{Username: "user", Target: "127.0.0.1:3130"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := running.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if config, err := running.Resolve("user", "new"); err != nil || config.Target != "127.0.0.1:3130" {
+		t.Fatalf("expected the password kept, got %v", err)
+	}
+
+	if err := other.RemoveProxy(ctx, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := running.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := running.Resolve("user", "new"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("deleted proxy still routable: %v", err)
+	}
+}
+
+func TestQuarantinedProxyIsRefused(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestRouter(t)
+	if err := pr.AddProxy(ctx, &ProxyConfig{Username: "user", Password: "pass", Target: "127.0.0.1:3128"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pr.SetStatus(ctx, "user", repository.StatusQuarantined); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Resolve("user", "pass"); !errors.Is(err, ErrNoUpstream) {
+		t.Fatalf("expected quarantined proxy to be refused, got %v", err)
+	}
+
+	if err := pr.SetStatus(ctx, "user", "gone"); !errors.Is(err, ErrInvalidStatus) {
+		t.Fatalf("expected invalid status error, got %v", err)
+	}
+
+	if err := pr.SetStatus(ctx, "user", repository.StatusActive); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Resolve("user", "pass"); err != nil {
+		t.Fatalf("revived proxy refused: %v", err)
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestPool(t, StrategyRoundRobin, 1)
+
+	for _, username := range []string{"member0", "pooluser"} {
+		if err := pr.SetPassword(ctx, username, "rotated"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pr.Resolve(username, "rotated"); err != nil {
+			t.Fatalf("new password of %s refused: %v", username, err)
+		}
+	}
+
+	if _, err := pr.Resolve("pooluser", "pass"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected old password to be refused, got %v", err)
+	}
+	if err := pr.SetPassword(ctx, "missing", "rotated"); !errors.Is(err, ErrProxyNotFound) {
+		t.Fatalf("expected ErrProxyNotFound, got %v", err)
+	}
+	if err := pr.SetPasswords(ctx, map[string]string{"member0": "again", "missing": "again"}); !errors.Is(err, ErrProxyNotFound) {
+		t.Fatalf("expected ErrProxyNotFound, got %v", err)
+	}
+	if _, err := pr.Resolve("member0", "rotated"); err != nil {
+		t.Fatalf("password changed by a failed rotation: %v", err)
+	}
+
+	// The new password survives a reload from storage.
+	if err := pr.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Resolve("member0", "rotated"); err != nil {
+		t.Fatalf("password lost on reload: %v", err)
+	}
+}
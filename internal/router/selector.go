@@ -0,0 +1,169 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+var (
+	ErrInvalidTag      = errors.New("invalid tag")
+	ErrInvalidSelector = errors.New("invalid selector")
+	ErrNoMatch         = errors.New("no upstream matches the selector")
+)
+
+// anonymityRank orders anonymity levels, a selector accepts its level and above.
+var anonymityRank = map[string]int{
+	repository.AnonymityTransparent: 1,
+	repository.AnonymityAnonymous:   2,
+	repository.AnonymityElite:       3,
+}
+
+// Selector narrows the upstreams a client may be routed to by what the checker
+// learned about their exit and by the tags given to them. Zero fields match
+// any upstream.
+type Selector struct {
+	Country   string
+	ASN       uint
+	Anonymity string
+	Tags      []string
+}
+
+// ParseSelector builds a selector from username parameters, e.g. the
+// country and tag of user-country-de-tag-residential. Several tags are joined
+// with "+" and must all be present.
+func ParseSelector(params map[string]string) (Selector, error) {
+	var s Selector
+	for key, value := range params {
+		switch key {
+		case "country":
+			if len(value) != 2 {
+				return Selector{}, fmt.Errorf("%w: country %q is not a two-letter code", ErrInvalidSelector, value)
+			}
+			s.Country = strings.ToUpper(value)
+		case "asn":
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32)
+			if err != nil {
+				return Selector{}, fmt.Errorf("%w: asn %q", ErrInvalidSelector, value)
+			}
+			s.ASN = uint(asn)
+		case "anonymity":
+			value = strings.ToLower(value)
+			if _, exists := anonymityRank[value]; !exists {
+				return Selector{}, fmt.Errorf("%w: anonymity %q", ErrInvalidSelector, value)
+			}
+			s.Anonymity = value
+		case "tag":
+			tags, err := NormalizeTags(strings.Split(value, "+"))
+			if err != nil {
+				return Selector{}, fmt.Errorf("%w: %v", ErrInvalidSelector, err)
+			}
+			s.Tags = tags
+		default:
+			return Selector{}, fmt.Errorf("%w: unknown key %q", ErrInvalidSelector, key)
+		}
+	}
+	return s, nil
+}
+
+// ParseSelectHeader parses the value of an X-Proxy-Select header, key=value
+// pairs separated by ";" or ",", e.g. "country=de; tag=residential+mobile".
+func ParseSelectHeader(value string) (Selector, error) {
+	params := make(map[string]string)
+	for _, pair := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == ',' }) {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			return Selector{}, fmt.Errorf("%w: %q is not a key=value pair", ErrInvalidSelector, pair)
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return ParseSelector(params)
+}
+
+// IsZero reports whether s matches any upstream.
+func (s Selector) IsZero() bool {
+	return s.Country == "" && s.ASN == 0 && s.Anonymity == "" && len(s.Tags) == 0
+}
+
+// Merge returns s with the fields set in other taking precedence.
+func (s Selector) Merge(other Selector) Selector {
+	if other.Country != "" {
+		s.Country = other.Country
+	}
+	if other.ASN != 0 {
+		s.ASN = other.ASN
+	}
+	if other.Anonymity != "" {
+		s.Anonymity = other.Anonymity
+	}
+	if len(other.Tags) > 0 {
+		tags, _ := NormalizeTags(append(slices.Clone(s.Tags), other.Tags...))
+		s.Tags = tags
+	}
+	return s
+}
+
+// Matches reports whether the upstream of config satisfies s.
+func (s Selector) Matches(config *ProxyConfig) bool {
+	if s.Country != "" && !strings.EqualFold(config.Exit.Country, s.Country) {
+		return false
+	}
+	if s.ASN != 0 && config.Exit.ASN != s.ASN {
+		return false
+	}
+	if s.Anonymity != "" && anonymityRank[config.Exit.Anonymity] < anonymityRank[s.Anonymity] {
+		return false
+	}
+	for _, tag := range s.Tags {
+		if !slices.Contains(config.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	var parts []string
+	if s.Country != "" {
+		parts = append(parts, "country="+s.Country)
+	}
+	if s.ASN != 0 {
+		parts = append(parts, "asn="+strconv.FormatUint(uint64(s.ASN), 10))
+	}
+	if s.Anonymity != "" {
+		parts = append(parts, "anonymity="+s.Anonymity)
+	}
+	if len(s.Tags) > 0 {
+		parts = append(parts, "tag="+strings.Join(s.Tags, "+"))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// NormalizeTags lowercases, sorts and deduplicates tags. Tags may contain
+// letters, digits, "_", "." and ":" so they fit in a username parameter.
+func NormalizeTags(tags []string) ([]string, error) {
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		for _, r := range tag {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '.' && r != ':' {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+			}
+		}
+		result = append(result, tag)
+	}
+
+	slices.Sort(result)
+	result = slices.Compact(result)
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
@@ -0,0 +1,92 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+func TestParseSelectHeader(t *testing.T) {
+	selector, err := ParseSelectHeader("country=de; tag=Mobile+residential, anonymity=anonymous; asn=AS3320")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selector.Country != "DE" || selector.ASN != 3320 || selector.Anonymity != repository.AnonymityAnonymous ||
+		!slices.Equal(selector.Tags, []string{"mobile", "residential"}) {
+		t.Fatalf("unexpected selector: %+v", selector)
+	}
+
+	for _, value := range []string{"country", "country=germany", "city=berlin", "tag=a b", "anonymity=high"} {
+		if _, err := ParseSelectHeader(value); !errors.Is(err, ErrInvalidSelector) {
+			t.Fatalf("%q: expected ErrInvalidSelector, got %v", value, err)
+		}
+	}
+}
+
+func TestSelectorRouting(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestPool(t, StrategyRoundRobin, 3)
+	if err := pr.SetTags(ctx, "member0", []string{"residential"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.SetTags(ctx, "member1", []string{"Residential", "mobile"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.repo.SetExitInfo(ctx, "member2", repository.ExitInfo{IP: "203.0.113.1", Country: "DE", Anonymity: repository.AnonymityElite}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		selector string
+		want     string
+	}{
+		{username: "pooluser-tag-mobile+residential", password: "pass", want: "member1"},
+		{username: "pooluser-country-de", password: "pass", want: "member2"},
+		{username: "pooluser-anonymity-anonymous", password: "pass", want: "member2"},
+		{username: "pooluser-session-abc-tag-mobile", password: "pass", want: "member1"},
+		{username: "pooluser", password: "pass", selector: "country=DE", want: "member2"},
+		{username: "pooluser-tag-residential", password: "pass", selector: "tag=mobile", want: "member1"},
+		{username: "member2-country-de", password: "x", want: "member2"},
+	}
+	for _, tt := range tests {
+		creds := ParseCredentials(tt.username, tt.password)
+		if tt.selector != "" {
+			selector, err := ParseSelectHeader(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			creds.Select = selector
+		}
+
+		for i := 0; i < 3; i++ {
+			config, err := pr.ResolveCredentials(creds)
+			if err != nil {
+				t.Fatalf("%s %q: %v", tt.username, tt.selector, err)
+			}
+			if config.Username != tt.want {
+				t.Fatalf("%s %q: expected %s, got %s", tt.username, tt.selector, tt.want, config.Username)
+			}
+		}
+	}
+
+	if _, err := pr.Resolve("pooluser-country-fr", "pass"); !errors.Is(err, ErrNoMatch) {
+		t.Fatalf("expected ErrNoMatch for pool, got %v", err)
+	}
+	if _, err := pr.Resolve("member0-tag-mobile", "x"); !errors.Is(err, ErrNoMatch) {
+		t.Fatalf("expected ErrNoMatch for proxy, got %v", err)
+	}
+	if _, err := pr.Resolve("pooluser-city-berlin", "pass"); !errors.Is(err, ErrInvalidSelector) {
+		t.Fatalf("expected ErrInvalidSelector, got %v", err)
+	}
+	if _, err := pr.Resolve("pooluser-city-berlin", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package router
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+const DefaultSessionTTL = 10 * time.Minute
+
+// Credentials is a parsed client login. Usernames may carry parameters as
+// "-key-value" pairs after the base username, e.g. user-session-abc123 or
+// user-country-de.
+type Credentials struct {
+	Raw      string
+	Username string
+	Password string
+	Session  string
+	Params   map[string]string
+
+	// Select narrows the upstreams on top of the username parameters, e.g.
+	// from an X-Proxy-Select header, and wins over them.
+	Select Selector
+}
+
+// ParseCredentials splits a raw username into the base username and its parameters.
+// A username that does not follow the key-value form is kept as is.
+func ParseCredentials(username, password string) Credentials {
+	creds := Credentials{
+		Raw:      username,
+		Username: username,
+		Password: password,
+	}
+
+	parts := strings.Split(username, "-")
+	if len(parts) < 3 || len(parts)%2 != 1 || parts[0] == "" {
+		return creds
+	}
+
+	params := make(map[string]string, len(parts)/2)
+	for i := 1; i < len(parts); i += 2 {
+		key, value := strings.ToLower(parts[i]), parts[i+1]
+		if !isParamKey(key) || value == "" {
+			return creds
+		}
+		params[key] = value
+	}
+
+	creds.Username = parts[0]
+	creds.Session = params["session"]
+	delete(params, "session")
+	if len(params) > 0 {
+		creds.Params = params
+	}
+
+	return creds
+}
+
+// selector returns the upstreams creds ask for when logging in as username.
+// Parameters of a username stored verbatim are part of it and select nothing.
+func (creds Credentials) selector(username string) (Selector, error) {
+	if username == creds.Raw {
+		return creds.Select, nil
+	}
+
+	selector, err := ParseSelector(creds.Params)
+	if err != nil {
+		return Selector{}, err
+	}
+	return selector.Merge(creds.Select), nil
+}
+
+func isParamKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+type Option func(*ProxyRouter)
+
+// WithSessionTTL sets how long a session ID stays pinned to the same pool member.
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(pr *ProxyRouter) {
+		if ttl > 0 {
+			pr.sessionTTL = ttl
+		}
+	}
+}
+
+type session struct {
+	member  string
+	expires time.Time
+}
+
+// sessionMember returns the member pinned to the session, pinning a newly
+// picked one when the session is unknown, expired, or its member is gone,
+// unroutable, unhealthy, already tried, not selected or its circuit is open.
+// Callers must hold pr.mu.
+func (pr *ProxyRouter) sessionMember(pool *PoolConfig, id string, tried []string, selector Selector) (*ProxyConfig, error) {
+	pr.sessionsMu.Lock()
+	defer pr.sessionsMu.Unlock()
+
+	now := time.Now()
+	key := pool.Username + "/" + id
+
+	if s, exists := pr.sessions[key]; exists && now.Before(s.expires) {
+		config, exists := pr.cache[s.member]
+		if exists && config.Routable() && selector.Matches(config) && slices.Contains(pool.Members, s.member) && !slices.Contains(tried, s.member) &&
+			(config.state == nil || config.state.healthy.Load()) && pr.available(config) {
+			return pr.take(config), nil
+		}
+	}
+
+	config, err := pr.pickMember(pool, tried, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	if now.Sub(pr.lastSweep) > pr.sessionTTL {
+		for k, s := range pr.sessions {
+			if now.After(s.expires) {
+				delete(pr.sessions, k)
+			}
+		}
+		pr.lastSweep = now
+	}
+
+	pr.sessions[key] = &session{
+		member:  config.Username,
+		expires: now.Add(pr.sessionTTL),
+	}
+
+	return config, nil
+}
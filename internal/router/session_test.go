@@ -0,0 +1,101 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseCredentials(t *testing.T) {
+	tests := []struct {
+		raw      string
+		username string
+		session  string
+		country  string
+	}{
+		{raw: "user", username: "user"},
+		{raw: "user-session-abc123", username: "user", session: "abc123"},
+		{raw: "user-country-de", username: "user", country: "de"},
+		{raw: "user-country-de-session-x1", username: "user", session: "x1", country: "de"},
+		{raw: "my-user", username: "my-user"},
+		{raw: "user-session-", username: "user-session-"},
+		{raw: "user-1-abc", username: "user-1-abc"},
+	}
+
+	for _, tt := range tests {
+		creds := ParseCredentials(tt.raw, "pass")
+		if creds.Username != tt.username || creds.Session != tt.session || creds.Params["country"] != tt.country {
+			t.Errorf("ParseCredentials(%q) = %+v", tt.raw, creds)
+		}
+		if creds.Raw != tt.raw || creds.Password != "pass" {
+			t.Errorf("ParseCredentials(%q) lost raw credentials: %+v", tt.raw, creds)
+		}
+	}
+}
+
+func TestSessionPinning(t *testing.T) {
+	pr := newTestPool(t, StrategyRoundRobin, 3)
+
+	first, err := pr.Resolve("pooluser-session-abc", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		config, err := pr.Resolve("pooluser-session-abc", "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Username != first.Username {
+			t.Fatalf("session moved from %s to %s", first.Username, config.Username)
+		}
+	}
+
+	pr.SetHealth(first.Username, false, 0)
+	moved, err := pr.Resolve("pooluser-session-abc", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Username == first.Username {
+		t.Fatal("session stayed on an unhealthy member")
+	}
+
+	if _, err := pr.Resolve("pooluser-session-abc", "wrong"); err == nil {
+		t.Fatal("expected session login with wrong password to fail")
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	pr := newTestPool(t, StrategyRoundRobin, 2)
+	pr.sessionTTL = time.Millisecond
+
+	first, err := pr.Resolve("pooluser-session-abc", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Round robin moves on to the other member once the pin is gone.
+	next, err := pr.Resolve("pooluser-session-abc", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Username == first.Username {
+		t.Fatal("expired session was not re-picked")
+	}
+}
+
+func TestVerbatimUsernameWins(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestRouter(t)
+	if err := pr.AddProxy(ctx, &ProxyConfig{Username: "user-session-abc", Password: "pass", Target: "127.0.0.1:3128"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := pr.Resolve("user-session-abc", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "user-session-abc" {
+		t.Fatalf("unexpected proxy %s", config.Username)
+	}
+}
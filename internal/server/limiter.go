@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/router"
+)
+
+const limiterSweepInterval = time.Minute
+
+var (
+	ErrRateLimited  = errors.New("rate limit exceeded")
+	ErrTooManyConns = errors.New("too many concurrent connections")
+)
+
+// Limiter enforces per-user request rates and concurrent tunnel caps. One
+// Limiter should be shared by all listeners so a user's limits hold across them.
+type Limiter struct {
+	router   *router.ProxyRouter
+	defaults repository.Limits
+
+	mu        sync.Mutex
+	users     map[string]*userLimit
+	lastSweep time.Time
+}
+
+type userLimit struct {
+	tokens float64
+	last   time.Time
+	conns  int
+}
+
+// NewLimiter creates a limiter applying the limits stored for each user, with
+// defaults for the values a user leaves at zero. Zero defaults mean unlimited.
+func NewLimiter(r *router.ProxyRouter, defaults repository.Limits) *Limiter {
+	return &Limiter{
+		router:   r,
+		defaults: defaults,
+		users:    make(map[string]*userLimit),
+	}
+}
+
+// WithLimiter applies the limits of l to every authenticated client.
+func WithLimiter(l *Limiter) Option {
+	return func(d *upstreamDialer) {
+		d.limiter = l
+	}
+}
+
+func (l *Limiter) limits(creds router.Credentials) (string, repository.Limits) {
+	username, limits := l.router.UserLimits(creds)
+	if limits.RateLimit == 0 {
+		limits.RateLimit = l.defaults.RateLimit
+	}
+	if limits.RateBurst == 0 {
+		limits.RateBurst = l.defaults.RateBurst
+	}
+	if limits.MaxConns == 0 {
+		limits.MaxConns = l.defaults.MaxConns
+	}
+	if limits.RateBurst <= 0 {
+		limits.RateBurst = max(1, int(math.Ceil(limits.RateLimit)))
+	}
+	return username, limits
+}
+
+// Allow takes a token from the bucket of the user behind creds, or returns
+// ErrRateLimited when it is empty.
+func (l *Limiter) Allow(creds router.Credentials) error {
+	if l == nil {
+		return nil
+	}
+
+	username, limits := l.limits(creds)
+	if limits.RateLimit <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	user := l.user(username, now)
+
+	burst := float64(limits.RateBurst)
+	if user.last.IsZero() {
+		user.tokens = burst
+	} else {
+		user.tokens = min(burst, user.tokens+now.Sub(user.last).Seconds()*limits.RateLimit)
+	}
+	user.last = now
+
+	if user.tokens < 1 {
+		return ErrRateLimited
+	}
+	user.tokens--
+	return nil
+}
+
+// AcquireConn reserves a tunnel slot for the user behind creds, or returns
+// ErrTooManyConns when all are taken. The returned function frees the slot.
+func (l *Limiter) AcquireConn(creds router.Credentials) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	username, limits := l.limits(creds)
+	if limits.MaxConns <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	user := l.user(username, time.Now())
+	if user.conns >= limits.MaxConns {
+		return nil, ErrTooManyConns
+	}
+	user.conns++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			user.conns--
+		})
+	}, nil
+}
+
+// user returns the state of username, dropping idle users once in a while.
+// Callers must hold l.mu.
+func (l *Limiter) user(username string, now time.Time) *userLimit {
+	if now.Sub(l.lastSweep) > limiterSweepInterval {
+		for name, user := range l.users {
+			if user.conns == 0 && now.Sub(user.last) > limiterSweepInterval {
+				delete(l.users, name)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	user, exists := l.users[username]
+	if !exists {
+		user = &userLimit{}
+		l.users[username] = user
+	}
+	return user
+}
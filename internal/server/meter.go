@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/router"
+)
+
+const usageDayLayout = "2006-01-02"
+
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// Meter counts the bytes each user moves through each upstream, flushes the
+// counts to the repository and rejects users over their daily or monthly quota.
+type Meter struct {
+	router *router.ProxyRouter
+	repo   repository.IProxyRepository
+
+	mu      sync.Mutex
+	pending map[usageKey]*repository.UsageModel
+	totals  map[string]*usageTotal
+}
+
+type usageKey struct {
+	username string
+	upstream string
+	day      string
+}
+
+// usageTotal is the traffic of a user in the current UTC day and month.
+type usageTotal struct {
+	day        string
+	dayBytes   int64
+	month      string
+	monthBytes int64
+}
+
+func (t *usageTotal) roll(day string) {
+	if t.day != day {
+		t.day, t.dayBytes = day, 0
+	}
+	if t.month != day[:7] {
+		t.month, t.monthBytes = day[:7], 0
+	}
+}
+
+// NewMeter creates a meter seeded with the usage stored for the current month.
+func NewMeter(ctx context.Context, r *router.ProxyRouter, repo repository.IProxyRepository) (*Meter, error) {
+	m := &Meter{
+		router:  r,
+		repo:    repo,
+		pending: make(map[usageKey]*repository.UsageModel),
+		totals:  make(map[string]*usageTotal),
+	}
+
+	today := time.Now().UTC().Format(usageDayLayout)
+	records, err := repo.FindUsage(ctx, today[:7]+"-01")
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		m.total(record.Username, today)
+		total := m.totals[record.Username]
+		total.monthBytes += record.BytesUp + record.BytesDown
+		if record.Day == today {
+			total.dayBytes += record.BytesUp + record.BytesDown
+		}
+	}
+
+	return m, nil
+}
+
+// WithMeter counts the traffic of every tunnel and enforces quotas with m.
+func WithMeter(m *Meter) Option {
+	return func(d *upstreamDialer) {
+		d.meter = m
+	}
+}
+
+// Run flushes the counts every interval until ctx is done, then flushes once
+// more, past the cancellation of ctx. Counts that fail to flush are kept for
+// the next attempt.
+func (m *Meter) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return m.Flush(context.WithoutCancel(ctx))
+		case <-ticker.C:
+			_ = m.Flush(ctx)
+		}
+	}
+}
+
+// Flush writes the counts gathered since the last flush to the repository.
+func (m *Meter) Flush(ctx context.Context) error {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[usageKey]*repository.UsageModel)
+	m.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	records := make([]*repository.UsageModel, 0, len(pending))
+	for _, record := range pending {
+		records = append(records, record)
+	}
+
+	if err := m.repo.AddUsage(ctx, records); err != nil {
+		m.mu.Lock()
+		for key, record := range pending {
+			m.addLocked(key, record.BytesUp, record.BytesDown, false)
+		}
+		m.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// CheckQuota returns ErrQuotaExceeded once the user behind creds used up a quota.
+func (m *Meter) CheckQuota(creds router.Credentials) error {
+	if m == nil {
+		return nil
+	}
+
+	username, limits := m.router.UserLimits(creds)
+	if limits.DailyQuota <= 0 && limits.MonthlyQuota <= 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := m.total(username, time.Now().UTC().Format(usageDayLayout))
+	if limits.DailyQuota > 0 && total.dayBytes >= limits.DailyQuota {
+		return ErrQuotaExceeded
+	}
+	if limits.MonthlyQuota > 0 && total.monthBytes >= limits.MonthlyQuota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (m *Meter) add(username, upstream string, up, down int64) {
+	if m == nil {
+		return
+	}
+
+	day := time.Now().UTC().Format(usageDayLayout)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.addLocked(usageKey{username: username, upstream: upstream, day: day}, up, down, true)
+}
+
+// addLocked adds to the pending counts and, when count is set, to the totals
+// checked against quotas. Callers must hold m.mu.
+func (m *Meter) addLocked(key usageKey, up, down int64, count bool) {
+	record, exists := m.pending[key]
+	if !exists {
+		record = &repository.UsageModel{Username: key.username, Upstream: key.upstream, Day: key.day}
+		m.pending[key] = record
+	}
+	record.BytesUp += up
+	record.BytesDown += down
+
+	if count {
+		total := m.total(key.username, key.day)
+		total.dayBytes += up + down
+		total.monthBytes += up + down
+	}
+}
+
+// total returns the totals of username rolled over to day. Callers must hold m.mu.
+func (m *Meter) total(username, day string) *usageTotal {
+	total, exists := m.totals[username]
+	if !exists {
+		total = &usageTotal{}
+		m.totals[username] = total
+	}
+	total.roll(day)
+	return total
+}
@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/base64"
-	"fmt"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -14,16 +14,21 @@ import (
 	"github.com/stickpro/p-router/internal/router"
 )
 
+// selectHeader carries a selector for the upstream on plain HTTP, see router.ParseSelectHeader.
+const selectHeader = "X-Proxy-Select"
+
 type Server struct {
 	addr   string
 	router *router.ProxyRouter
+	dialer *upstreamDialer
 	server *http.Server
 }
 
-func NewServer(addr string, r *router.ProxyRouter) *Server {
+func NewServer(addr string, r *router.ProxyRouter, opts ...Option) *Server {
 	s := &Server{
 		addr:   addr,
 		router: r,
+		dialer: newUpstreamDialer(r, opts...),
 	}
 
 	s.server = &http.Server{
@@ -44,78 +49,103 @@ func (s *Server) Stop(ctx context.Context) error {
 	return s.server.Shutdown(ctx)
 }
 
-func parseProxyAuth(authHeader string) (string, string, bool) {
+func parseProxyAuth(authHeader string) (router.Credentials, bool) {
 	if authHeader == "" {
-		return "", "", false
+		return router.Credentials{}, false
 	}
 
 	parts := strings.SplitN(authHeader, " ", 2)
 	if len(parts) != 2 || parts[0] != "Basic" {
-		return "", "", false
+		return router.Credentials{}, false
 	}
 
 	decoded, err := base64.StdEncoding.DecodeString(parts[1])
 	if err != nil {
-		return "", "", false
+		return router.Credentials{}, false
 	}
 
 	credentials := strings.SplitN(string(decoded), ":", 2)
 	if len(credentials) != 2 {
-		return "", "", false
+		return router.Credentials{}, false
 	}
 
-	return credentials[0], credentials[1], true
+	return router.ParseCredentials(credentials[0], credentials[1]), true
 }
 
 func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	username, password, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		s.dialer.metrics.Request(r.Method, rec.status)
+	}()
+	w = rec
+
+	creds, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
 	if !ok {
 		w.Header().Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
 		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
 		return
 	}
 
-	config, valid := s.router.GetProxy(username, password)
-	if !valid {
+	if value := r.Header.Get(selectHeader); value != "" {
+		selector, err := router.ParseSelectHeader(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		creds.Select = selector
+	}
+
+	config, err := s.router.ResolveCredentials(creds)
+	switch {
+	case errors.Is(err, router.ErrInvalidCredentials):
+		s.dialer.metrics.AuthFailure("http")
 		w.Header().Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
 		http.Error(w, "Invalid credentials", http.StatusProxyAuthRequired)
 		return
+	case errors.Is(err, router.ErrInvalidSelector):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, router.ErrNoMatch):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := s.dialer.admit(creds); err != nil {
+		status := http.StatusTooManyRequests
+		if errors.Is(err, ErrQuotaExceeded) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
 	}
 
 	if r.Method == http.MethodConnect {
-		s.handleConnect(w, r, config)
+		s.handleConnect(w, r, creds, config)
 	} else {
-		s.handleHTTPRequest(w, r, config)
+		s.handleHTTPRequest(w, r, creds, config)
 	}
 }
 
-func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request, config *router.ProxyConfig) {
-	targetConn, err := net.DialTimeout("tcp", config.Target, 10*time.Second)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Cannot connect to proxy: %v", err), http.StatusServiceUnavailable)
-		return
-	}
-	defer targetConn.Close()
-
-	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", r.Host, r.Host)
-	_, err = targetConn.Write([]byte(connectReq))
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request, creds router.Credentials, config *router.ProxyConfig) {
+	release, err := s.dialer.limiter.AcquireConn(creds)
 	if err != nil {
-		http.Error(w, "Failed to send CONNECT", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
 		return
 	}
+	defer release()
 
-	reader := bufio.NewReader(targetConn)
-	resp, err := http.ReadResponse(reader, r)
+	targetConn, config, err := s.dialer.dial(r.Context(), creds, config, func(ctx context.Context, config *router.ProxyConfig) (net.Conn, error) {
+		return dialUpstream(ctx, config, r.Host)
+	})
 	if err != nil {
-		http.Error(w, "Failed to read proxy response", http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, fmt.Sprintf("Proxy returned: %s", resp.Status), resp.StatusCode)
+		writeUpstreamError(w, err)
 		return
 	}
+	defer targetConn.Close()
+	defer s.router.Acquire(config)()
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -129,6 +159,7 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request, config *r
 		return
 	}
 	defer clientConn.Close()
+	defer s.dialer.metrics.TunnelOpened("http")()
 
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
@@ -136,18 +167,37 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request, config *r
 	io.Copy(clientConn, targetConn)
 }
 
-func (s *Server) handleHTTPRequest(w http.ResponseWriter, r *http.Request, config *router.ProxyConfig) {
-	targetConn, err := net.DialTimeout("tcp", config.Target, 10*time.Second)
+func (s *Server) handleHTTPRequest(w http.ResponseWriter, r *http.Request, creds router.Credentials, config *router.ProxyConfig) {
+	targetConn, config, err := s.dialer.dial(r.Context(), creds, config, func(ctx context.Context, config *router.ProxyConfig) (net.Conn, error) {
+		return dialForward(ctx, config, r)
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Cannot connect to proxy: %v", err), http.StatusServiceUnavailable)
+		writeUpstreamError(w, err)
 		return
 	}
 	defer targetConn.Close()
+	defer s.router.Acquire(config)()
+
+	proxy, err := config.Upstream()
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	proxyForm := proxy.IsHTTP()
 
 	r.Header.Del("Proxy-Authorization")
 	r.Header.Del("Proxy-Connection")
+	r.Header.Del(selectHeader)
 
-	if err := r.Write(targetConn); err != nil {
+	if proxyForm {
+		if auth := proxy.AuthHeader(); auth != "" {
+			r.Header.Set("Proxy-Authorization", auth)
+		}
+		err = r.WriteProxy(targetConn)
+	} else {
+		err = r.Write(targetConn)
+	}
+	if err != nil {
 		http.Error(w, "Failed to send request to proxy", http.StatusInternalServerError)
 		return
 	}
@@ -169,3 +219,23 @@ func (s *Server) handleHTTPRequest(w http.ResponseWriter, r *http.Request, confi
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 }
+
+// statusRecorder remembers the response status for metrics. Hijacked
+// connections keep the initial 200.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return hijacker.Hijack()
+}
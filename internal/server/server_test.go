@@ -0,0 +1,401 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stickpro/p-router/internal/metrics"
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/router"
+)
+
+// closedAddr returns an address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func connectThrough(t *testing.T, proxyAddr, username, password string) (net.Conn, *http.Response) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic %s\r\n\r\n", auth)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &bufferedTestConn{Conn: conn, reader: reader}, resp
+}
+
+type bufferedTestConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedTestConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func TestConnectFailover(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestRouter(t)
+	if err := pr.AddPool(ctx, &router.PoolConfig{Name: "pool", Username: "pooluser", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	for i, target := range []string{closedAddr(t), startEchoUpstream(t)} {
+		username := fmt.Sprintf("member%d", i)
+		if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: username, Password: "x", Target: target}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pr.AddPoolMember(ctx, "pool", username); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := NewServer("", pr, WithFailover(3, 5*time.Second))
+	ts := httptest.NewServer(http.HandlerFunc(srv.handleHTTP))
+	t.Cleanup(ts.Close)
+
+	conn, resp := connectThrough(t, ts.Listener.Addr().String(), "pooluser", "pass")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tunnel through the live member, got %s", resp.Status)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dead member was reported and is skipped from now on.
+	config, err := pr.Resolve("pooluser", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "member1" {
+		t.Fatalf("dead member still picked: %s", config.Username)
+	}
+	// Live traffic leaves the persisted counters to the checker.
+	model, err := pr.FindProxy(ctx, "member0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.FailedChecks != 0 {
+		t.Fatalf("live failure persisted, failed_checks = %d", model.FailedChecks)
+	}
+}
+
+func TestConnectFailoverOnRefusal(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestRouter(t)
+	if err := pr.AddPool(ctx, &router.PoolConfig{Name: "pool", Username: "pooluser", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	for i, target := range []string{startRefusingUpstream(t), startEchoUpstream(t)} {
+		username := fmt.Sprintf("member%d", i)
+		if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: username, Password: "x", Target: target}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pr.AddPoolMember(ctx, "pool", username); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := NewServer("", pr, WithFailover(3, 5*time.Second))
+	ts := httptest.NewServer(http.HandlerFunc(srv.handleHTTP))
+	t.Cleanup(ts.Close)
+
+	conn, resp := connectThrough(t, ts.Listener.Addr().String(), "pooluser", "pass")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tunnel through the next member, got %s", resp.Status)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The refusing upstream answered, so round robin still reaches it.
+	picked := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		config, err := pr.Resolve("pooluser", "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[config.Username] = true
+	}
+	if !picked["member0"] {
+		t.Fatal("upstream blamed for its destination")
+	}
+}
+
+// startRefusingUpstream runs an HTTP proxy that answers every CONNECT with 403.
+func startRefusingUpstream(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestConnectRefusedBySocks5KeepsCircuitClosed(t *testing.T) {
+	ctx := context.Background()
+	pr := router.NewProxyRouter(newTestRepo(t), router.WithBreaker(1, time.Minute))
+	if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: "user", Password: "pass", Target: startSocks5RefusingUpstream(t)}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer("", pr)
+	ts := httptest.NewServer(http.HandlerFunc(srv.handleHTTP))
+	t.Cleanup(ts.Close)
+
+	_, resp := connectThrough(t, ts.Listener.Addr().String(), "user", "pass")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected the upstream refusal, got %s", resp.Status)
+	}
+
+	// A refused destination says nothing about the upstream.
+	if _, err := pr.Resolve("user", "pass"); err != nil {
+		t.Fatalf("circuit opened by a refused destination: %v", err)
+	}
+}
+
+// startSocks5RefusingUpstream runs a SOCKS5 proxy that answers every request
+// with connection refused (0x05).
+func startSocks5RefusingUpstream(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte{socks5Version, 0x00})
+
+				if _, err := io.ReadFull(conn, make([]byte, 3)); err != nil {
+					return
+				}
+				if _, err := readSocks5Addr(conn); err != nil {
+					return
+				}
+				_ = writeSocks5Reply(conn, socks5ReplyRefused, nil)
+			}()
+		}
+	}()
+
+	return "socks5://" + ln.Addr().String()
+}
+
+func TestConnectWithoutFailover(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestRouter(t)
+	if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: "user", Password: "pass", Target: closedAddr(t)}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer("", pr, WithFailover(3, 5*time.Second))
+	ts := httptest.NewServer(http.HandlerFunc(srv.handleHTTP))
+	t.Cleanup(ts.Close)
+
+	_, resp := connectThrough(t, ts.Listener.Addr().String(), "user", "pass")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for a dead single upstream, got %s", resp.Status)
+	}
+}
+
+func TestConnectLimits(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestRouter(t)
+	if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: "user", Password: "pass", Target: startEchoUpstream(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.SetLimits(ctx, "user", repository.Limits{MaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer("", pr, WithLimiter(NewLimiter(pr, repository.Limits{RateLimit: 1, RateBurst: 2})))
+	ts := httptest.NewServer(http.HandlerFunc(srv.handleHTTP))
+	t.Cleanup(ts.Close)
+
+	first, resp := connectThrough(t, ts.Listener.Addr().String(), "user", "pass")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected first tunnel, got %s", resp.Status)
+	}
+
+	_, resp = connectThrough(t, ts.Listener.Addr().String(), "user-session-abc", "pass")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected tunnel cap, got %s", resp.Status)
+	}
+	first.Close()
+
+	// The burst of 2 is spent by now.
+	_, resp = connectThrough(t, ts.Listener.Addr().String(), "user", "pass")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected rate limit, got %s", resp.Status)
+	}
+}
+
+func TestConnectQuota(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	pr := router.NewProxyRouter(repo)
+	if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: "user", Password: "pass", Target: startEchoUpstream(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.SetLimits(ctx, "user", repository.Limits{DailyQuota: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	meter, err := NewMeter(ctx, pr, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer("", pr, WithMeter(meter))
+	ts := httptest.NewServer(http.HandlerFunc(srv.handleHTTP))
+	t.Cleanup(ts.Close)
+
+	conn, resp := connectThrough(t, ts.Listener.Addr().String(), "user-session-abc", "pass")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tunnel, got %s", resp.Status)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, resp = connectThrough(t, ts.Listener.Addr().String(), "user", "pass")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected quota to be exceeded, got %s", resp.Status)
+	}
+
+	if err := meter.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	records, err := repo.FindUsage(ctx, "2000-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Username != "user" || records[0].BytesUp != 4 || records[0].BytesDown != 4 {
+		t.Fatalf("unexpected usage records: %+v", records)
+	}
+}
+
+func TestConnectMetrics(t *testing.T) {
+	ctx := context.Background()
+	pr := newTestRouter(t)
+	if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: "user", Password: "pass", Target: startEchoUpstream(t)}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := metrics.New(pr.Size)
+	srv := NewServer("", pr, WithMetrics(m))
+	ts := httptest.NewServer(http.HandlerFunc(srv.handleHTTP))
+	t.Cleanup(ts.Close)
+
+	conn, resp := connectThrough(t, ts.Listener.Addr().String(), "user", "pass")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tunnel, got %s", resp.Status)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp := connectThrough(t, ts.Listener.Addr().String(), "user", "wrong"); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected auth failure, got %s", resp.Status)
+	}
+	// Made up methods must not create label values.
+	req, err := http.NewRequest("BREW", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`p_router_active_tunnels{protocol="http"} 1`,
+		`p_router_auth_failures_total{protocol="http"} 1`,
+		`p_router_requests_total{method="CONNECT",status="407"} 1`,
+		`p_router_requests_total{method="other",status="407"} 1`,
+		`p_router_transferred_bytes_total{direction="up"} 4`,
+		`p_router_transferred_bytes_total{direction="down"} 4`,
+		`p_router_upstream_dial_duration_seconds_count{result="success",upstream="user"} 1`,
+		`p_router_cached_proxies 1`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics lack %q", line)
+		}
+	}
+}
@@ -0,0 +1,657 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/stickpro/p-router/internal/router"
+	"github.com/stickpro/p-router/internal/upstream"
+)
+
+const (
+	socks5Version          = 0x05
+	socks5AuthVersion      = 0x01
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAccept     = 0xff
+	socks5CmdConnect       = 0x01
+	socks5CmdUDP           = 0x03
+	socks5AddrIPv4         = 0x01
+	socks5AddrDomain       = 0x03
+	socks5AddrIPv6         = 0x04
+	socks5ReplySuccess     = 0x00
+	socks5ReplyFailure     = 0x01
+	socks5ReplyDenied      = 0x02
+	socks5ReplyNetUnreach  = 0x03
+	socks5ReplyHostUnreach = 0x04
+	socks5ReplyRefused     = 0x05
+	socks5ReplyTTLExpired  = 0x06
+	socks5ReplyNoCmd       = 0x07
+	socks5ReplyNoAddr      = 0x08
+	socks5HandshakeTime    = 30 * time.Second
+	socks5UDPBufferSize    = 64 * 1024
+)
+
+var ErrSocks5ServerClosed = errors.New("socks5: server closed")
+
+// Socks5Server accepts SOCKS5 clients with username/password auth (RFC 1929)
+// and routes them through the upstream proxy mapped to the username.
+type Socks5Server struct {
+	addr       string
+	router     *router.ProxyRouter
+	dialer     *upstreamDialer
+	udpEnabled bool
+
+	// ctx is the base of the dials made for clients, canceled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewSocks5Server(addr string, r *router.ProxyRouter, udpEnabled bool, opts ...Option) *Socks5Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Socks5Server{
+		addr:       addr,
+		router:     r,
+		dialer:     newUpstreamDialer(r, opts...),
+		udpEnabled: udpEnabled,
+		ctx:        ctx,
+		cancel:     cancel,
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Socks5Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+func (s *Socks5Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrSocks5ServerClosed
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrSocks5ServerClosed
+			}
+			return err
+		}
+
+		if !s.trackConn(conn) {
+			conn.Close()
+			return ErrSocks5ServerClosed
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrackConn(conn)
+			defer conn.Close()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Stop closes the listener and waits for active tunnels until ctx is done,
+// after which the remaining connections are closed forcibly.
+func (s *Socks5Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancel()
+		return err
+	case <-ctx.Done():
+		s.cancel()
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Socks5Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Socks5Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Socks5Server) handleConn(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeTime))
+
+	// An authenticated client without an upstream still gets its request
+	// answered, as RFC 1928 has no way to report that during auth.
+	creds, config, authErr := s.authenticate(conn)
+	var authReplyErr *socks5ReplyError
+	if authErr != nil && !errors.As(authErr, &authReplyErr) {
+		return
+	}
+
+	cmd, addr, err := readSocks5Request(conn)
+	if err != nil {
+		var replyErr *socks5ReplyError
+		if errors.As(err, &replyErr) {
+			_ = writeSocks5Reply(conn, replyErr.Code, nil)
+		}
+		return
+	}
+
+	if authReplyErr != nil {
+		_ = writeSocks5Reply(conn, authReplyErr.Code, nil)
+		return
+	}
+
+	if err := s.dialer.admit(creds); err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyDenied, nil)
+		return
+	}
+
+	switch cmd {
+	case socks5CmdConnect:
+		s.handleConnect(conn, creds, config, addr)
+	case socks5CmdUDP:
+		if !s.udpEnabled {
+			_ = writeSocks5Reply(conn, socks5ReplyNoCmd, nil)
+			return
+		}
+		s.handleUDPAssociate(conn, creds, config, addr)
+	default:
+		_ = writeSocks5Reply(conn, socks5ReplyNoCmd, nil)
+	}
+}
+
+func (s *Socks5Server) authenticate(conn net.Conn) (router.Credentials, *router.ProxyConfig, error) {
+	var creds router.Credentials
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return creds, nil, err
+	}
+	if header[0] != socks5Version {
+		return creds, nil, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return creds, nil, err
+	}
+
+	supported := false
+	for _, m := range methods {
+		if m == socks5AuthUserPass {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return creds, nil, errors.New("client does not support username/password auth")
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, socks5AuthUserPass}); err != nil {
+		return creds, nil, err
+	}
+
+	username, password, err := readSocks5Credentials(conn)
+	if err != nil {
+		return creds, nil, err
+	}
+
+	creds = router.ParseCredentials(username, password)
+	config, err := s.router.ResolveCredentials(creds)
+	if errors.Is(err, router.ErrInvalidCredentials) {
+		s.dialer.metrics.AuthFailure("socks5")
+		_, _ = conn.Write([]byte{socks5AuthVersion, 0x01})
+		return creds, nil, err
+	}
+
+	if _, err := conn.Write([]byte{socks5AuthVersion, 0x00}); err != nil {
+		return creds, nil, err
+	}
+
+	if errors.Is(err, router.ErrNoMatch) || errors.Is(err, router.ErrInvalidSelector) {
+		return creds, nil, &socks5ReplyError{Code: socks5ReplyDenied, Err: err}
+	}
+	if err != nil {
+		return creds, nil, &socks5ReplyError{Code: socks5ReplyFailure, Err: err}
+	}
+
+	return creds, config, nil
+}
+
+func (s *Socks5Server) handleConnect(conn net.Conn, creds router.Credentials, config *router.ProxyConfig, addr string) {
+	release, err := s.dialer.limiter.AcquireConn(creds)
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyDenied, nil)
+		return
+	}
+	defer release()
+
+	ctx, unwatch := s.watchClient(conn)
+	targetConn, config, err := s.dialer.dial(ctx, creds, config, func(ctx context.Context, config *router.ProxyConfig) (net.Conn, error) {
+		return dialUpstream(ctx, config, addr)
+	})
+	conn = unwatch()
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyCode(err), nil)
+		return
+	}
+	defer targetConn.Close()
+	defer s.router.Acquire(config)()
+
+	if err := writeSocks5Reply(conn, socks5ReplySuccess, targetConn.LocalAddr()); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	defer s.dialer.metrics.TunnelOpened("socks5")()
+
+	go func() {
+		_, _ = io.Copy(targetConn, conn)
+		// Unblock the reverse copy once the client side is gone.
+		targetConn.Close()
+	}()
+	_, _ = io.Copy(conn, targetConn)
+}
+
+// handleUDPAssociate relays datagrams for the client through a UDP
+// association on its upstream until either control connection is closed.
+// Only SOCKS5 upstreams can carry UDP, other clients are told the command is
+// not supported rather than sending from this host.
+func (s *Socks5Server) handleUDPAssociate(conn net.Conn, creds router.Credentials, config *router.ProxyConfig, clientAddr string) {
+	if proxy, err := config.Upstream(); err != nil || proxy.Scheme != upstream.SchemeSOCKS5 {
+		_ = writeSocks5Reply(conn, socks5ReplyNoCmd, nil)
+		return
+	}
+
+	release, err := s.dialer.limiter.AcquireConn(creds)
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyDenied, nil)
+		return
+	}
+	defer release()
+
+	var association *upstream.UDPAssociation
+	ctx, unwatch := s.watchClient(conn)
+	control, config, err := s.dialer.dial(ctx, creds, config, func(ctx context.Context, config *router.ProxyConfig) (net.Conn, error) {
+		proxy, err := config.Upstream()
+		if err != nil {
+			return nil, err
+		}
+		association, err = proxy.AssociateUDP(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return association, nil
+	})
+	conn = unwatch()
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyCode(err), nil)
+		return
+	}
+	defer control.Close()
+	defer s.router.Acquire(config)()
+
+	upstreamRelay, err := net.DialUDP("udp", nil, association.RelayAddr)
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyCode(err), nil)
+		return
+	}
+	defer upstreamRelay.Close()
+
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	if err := writeSocks5Reply(conn, socks5ReplySuccess, relay.LocalAddr()); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	defer s.dialer.metrics.TunnelOpened("socks5")()
+
+	expectedHost, _, _ := net.SplitHostPort(clientAddr)
+	expectedIP := net.ParseIP(expectedHost)
+	if expectedIP != nil && expectedIP.IsUnspecified() {
+		expectedIP = nil
+	}
+	if expectedIP == nil {
+		expectedIP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	closeRelays := sync.OnceFunc(func() {
+		relay.Close()
+		upstreamRelay.Close()
+	})
+	// The association lives as long as both TCP control connections.
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		closeRelays()
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, control)
+		closeRelays()
+	}()
+
+	count := s.dialer.counter(creds, config)
+	var client atomic.Pointer[net.UDPAddr]
+
+	// Replies already carry the header naming their source, they are passed
+	// on as they are.
+	go func() {
+		buf := make([]byte, socks5UDPBufferSize)
+		for {
+			n, err := upstreamRelay.Read(buf)
+			if err != nil {
+				closeRelays()
+				return
+			}
+			if to := client.Load(); to != nil {
+				count(0, int64(n))
+				_, _ = relay.WriteToUDP(buf[:n], to)
+			}
+		}
+	}()
+
+	buf := make([]byte, socks5UDPBufferSize)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		to := client.Load()
+		if to == nil {
+			if !from.IP.Equal(expectedIP) {
+				continue
+			}
+			to = from
+			client.Store(from)
+		}
+		if !from.IP.Equal(to.IP) || from.Port != to.Port {
+			continue
+		}
+
+		if _, _, err := parseSocks5UDPHeader(buf[:n]); err != nil {
+			continue
+		}
+		count(int64(n), 0)
+		_, _ = upstreamRelay.Write(buf[:n])
+	}
+}
+
+// watchClient returns the context of a dial made for the client on conn,
+// canceled when the server stops or the client hangs up. The client is not
+// expected to send anything before its reply, a byte read while watching is
+// put back in front of the conn that unwatch returns.
+func (s *Socks5Server) watchClient(conn net.Conn) (context.Context, func() net.Conn) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	read := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, err := conn.Read(buf)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+		read <- buf[:n]
+	}()
+
+	return ctx, func() net.Conn {
+		defer cancel()
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+		buf := <-read
+		_ = conn.SetReadDeadline(time.Time{})
+		if len(buf) == 0 {
+			return conn
+		}
+		return &prefixedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf), conn)}
+	}
+}
+
+// prefixedConn reads what was read from its Conn ahead of time first.
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+type socks5ReplyError struct {
+	Code byte
+	Err  error
+}
+
+func (e *socks5ReplyError) Error() string {
+	return e.Err.Error()
+}
+
+// socks5ReplyCode tells the client why its request failed. The reply of a
+// SOCKS5 upstream is passed on, refusals of other upstreams and dial errors
+// get the closest code, and general failure is left for the rest.
+func socks5ReplyCode(err error) byte {
+	var statusErr *upstream.StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.Reply != 0:
+			return statusErr.Reply
+		case statusErr.StatusCode == http.StatusForbidden:
+			return socks5ReplyDenied
+		case statusErr.StatusCode == http.StatusGatewayTimeout:
+			return socks5ReplyTTLExpired
+		case statusErr.StatusCode == http.StatusBadGateway, statusErr.StatusCode == http.StatusServiceUnavailable:
+			return socks5ReplyHostUnreach
+		}
+		return socks5ReplyFailure
+	}
+
+	var (
+		netErr net.Error
+		dnsErr *net.DNSError
+	)
+	switch {
+	case errors.Is(err, upstream.ErrUDPNotSupported):
+		return socks5ReplyNoCmd
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ReplyRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return socks5ReplyTTLExpired
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5ReplyNetUnreach
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5ReplyHostUnreach
+	}
+	return socks5ReplyFailure
+}
+
+func readSocks5Credentials(r io.Reader) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socks5AuthVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", header[0])
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return "", "", err
+	}
+
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(r, plen); err != nil {
+		return "", "", err
+	}
+
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", "", err
+	}
+
+	return string(username), string(password), nil
+}
+
+func readSocks5Request(r io.Reader) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socks5Version {
+		return 0, "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	addr, err := readSocks5Addr(r)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return header[1], addr, nil
+}
+
+func readSocks5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", &socks5ReplyError{Code: socks5ReplyNoAddr, Err: fmt.Errorf("unsupported address type %d", atyp[0])}
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func writeSocks5Reply(w io.Writer, code byte, bound net.Addr) error {
+	reply := []byte{socks5Version, code, 0x00}
+	reply = append(reply, encodeSocks5Addr(bound)...)
+	_, err := w.Write(reply)
+	return err
+}
+
+func encodeSocks5Addr(addr net.Addr) []byte {
+	var (
+		ip   net.IP
+		port int
+	)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socks5AddrIPv4}, ip4...)
+	} else if ip != nil {
+		b = append([]byte{socks5AddrIPv6}, ip.To16()...)
+	} else {
+		b = []byte{socks5AddrIPv4, 0, 0, 0, 0}
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func parseSocks5UDPHeader(packet []byte) (string, []byte, error) {
+	if len(packet) < 4 {
+		return "", nil, errors.New("short udp packet")
+	}
+	if packet[2] != 0x00 {
+		return "", nil, errors.New("fragmented udp packets are not supported")
+	}
+
+	r := bytes.NewReader(packet[3:])
+	addr, err := readSocks5Addr(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return addr, packet[len(packet)-r.Len():], nil
+}
@@ -0,0 +1,458 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/router"
+	"github.com/stickpro/p-router/internal/upstream"
+)
+
+func newTestRepo(t *testing.T) *repository.SQLiteRepository {
+	t.Helper()
+
+	repo, err := repository.NewSQLiteRepository(filepath.Join(t.TempDir(), "proxies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	return repo
+}
+
+func newTestRouter(t *testing.T) *router.ProxyRouter {
+	t.Helper()
+
+	return router.NewProxyRouter(newTestRepo(t))
+}
+
+// startEchoUpstream runs a minimal HTTP CONNECT proxy that echoes tunnel data back.
+func startEchoUpstream(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				_, _ = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+				_, _ = io.Copy(conn, reader)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func startSocks5(t *testing.T, target string, udpEnabled bool) string {
+	ctx := context.Background()
+	t.Helper()
+
+	pr := newTestRouter(t)
+	if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: "user", Password: "pass", Target: target}); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewSocks5Server(ln.Addr().String(), pr, udpEnabled)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Stop(ctx)
+	})
+
+	return ln.Addr().String()
+}
+
+func socks5Handshake(t *testing.T, conn net.Conn, username, password string) byte {
+	t.Helper()
+
+	if _, err := conn.Write([]byte{socks5Version, 1, socks5AuthUserPass}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5AuthUserPass {
+		t.Fatalf("unexpected auth method %d", reply[1])
+	}
+
+	auth := []byte{socks5AuthVersion, byte(len(username))}
+	auth = append(auth, username...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	if _, err := conn.Write(auth); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestSocks5Connect(t *testing.T) {
+	addr := startSocks5(t, startEchoUpstream(t), false)
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if status := socks5Handshake(t, conn, "user", "pass"); status != 0x00 {
+		t.Fatalf("auth failed with status %d", status)
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrDomain, byte(len("example.com"))}
+	req = append(req, "example.com"...)
+	req = binary.BigEndian.AppendUint16(req, 443)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5ReplySuccess {
+		t.Fatalf("connect failed with reply %d", reply[1])
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q", buf)
+	}
+}
+
+// startHangingUpstream runs an HTTP proxy that reads CONNECT requests and
+// never answers them. closed receives when the router hangs up on it.
+func startHangingUpstream(t *testing.T) (addr string, closed <-chan struct{}) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	hungUp := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+				hungUp <- struct{}{}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), hungUp
+}
+
+func socks5ConnectRequest(host string, port uint16) []byte {
+	req := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrDomain, byte(len(host))}
+	req = append(req, host...)
+	return binary.BigEndian.AppendUint16(req, port)
+}
+
+func TestSocks5ConnectCanceledWhenClientLeaves(t *testing.T) {
+	target, closed := startHangingUpstream(t)
+	addr := startSocks5(t, target, false)
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if status := socks5Handshake(t, conn, "user", "pass"); status != 0x00 {
+		t.Fatalf("auth failed with status %d", status)
+	}
+	if _, err := conn.Write(socks5ConnectRequest("example.com", 443)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the dial outlived the client")
+	}
+}
+
+func TestSocks5ConnectKeepsEarlyData(t *testing.T) {
+	addr := startSocks5(t, startEchoUpstream(t), false)
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if status := socks5Handshake(t, conn, "user", "pass"); status != 0x00 {
+		t.Fatalf("auth failed with status %d", status)
+	}
+
+	// The data follows the request without waiting for the reply.
+	if _, err := conn.Write(append(socks5ConnectRequest("example.com", 443), "ping"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5ReplySuccess {
+		t.Fatalf("connect failed with reply %d", reply[1])
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q", buf)
+	}
+}
+
+func TestSocks5InvalidCredentials(t *testing.T) {
+	addr := startSocks5(t, startEchoUpstream(t), false)
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if status := socks5Handshake(t, conn, "user", "wrong"); status == 0x00 {
+		t.Fatal("expected auth failure")
+	}
+}
+
+// startUDPUpstream runs a minimal SOCKS5 proxy that only accepts UDP
+// ASSOCIATE and whose relay echoes datagrams back unchanged.
+func startUDPUpstream(t *testing.T) string {
+	t.Helper()
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	go func() {
+		buf := make([]byte, socks5UDPBufferSize)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = relay.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte{socks5Version, 0x00})
+
+				header := make([]byte, 3)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				if _, err := readSocks5Addr(conn); err != nil {
+					return
+				}
+				if header[1] != socks5CmdUDP {
+					_ = writeSocks5Reply(conn, socks5ReplyNoCmd, nil)
+					return
+				}
+				_ = writeSocks5Reply(conn, socks5ReplySuccess, relay.LocalAddr())
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	return "socks5://" + ln.Addr().String()
+}
+
+func socks5Associate(t *testing.T, addr string) (net.Conn, byte, *net.UDPAddr) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if status := socks5Handshake(t, conn, "user", "pass"); status != 0x00 {
+		t.Fatalf("auth failed with status %d", status)
+	}
+
+	req := []byte{socks5Version, socks5CmdUDP, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	bound, err := readSocks5Addr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, _ := net.ResolveUDPAddr("udp", bound)
+	return conn, header[1], relay
+}
+
+func TestSocks5UDPAssociate(t *testing.T) {
+	addr := startSocks5(t, startUDPUpstream(t), true)
+
+	_, reply, relay := socks5Associate(t, addr)
+	if reply != socks5ReplySuccess {
+		t.Fatalf("associate failed with reply %d", reply)
+	}
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53}
+	packet := append(buildSocks5UDPHeader(target), "ping"...)
+	if _, err := client.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, socks5UDPBufferSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, payload, err := parseSocks5UDPHeader(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != "10.0.0.1:53" || string(payload) != "ping" {
+		t.Fatalf("unexpected datagram from %s: %q", from, payload)
+	}
+}
+
+func TestSocks5UDPAssociateHTTPUpstream(t *testing.T) {
+	addr := startSocks5(t, startEchoUpstream(t), true)
+
+	if _, reply, _ := socks5Associate(t, addr); reply != socks5ReplyNoCmd {
+		t.Fatalf("expected reply %d, got %d", socks5ReplyNoCmd, reply)
+	}
+}
+
+func TestSocks5ReplyCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"socks5 upstream reply", &upstream.StatusError{StatusCode: http.StatusBadGateway, Reply: socks5ReplyRefused}, socks5ReplyRefused},
+		{"http forbidden", &upstream.StatusError{StatusCode: http.StatusForbidden}, socks5ReplyDenied},
+		{"http gateway timeout", &upstream.StatusError{StatusCode: http.StatusGatewayTimeout}, socks5ReplyTTLExpired},
+		{"http bad gateway", &upstream.StatusError{StatusCode: http.StatusBadGateway}, socks5ReplyHostUnreach},
+		{"http proxy auth", &upstream.StatusError{StatusCode: http.StatusProxyAuthRequired}, socks5ReplyFailure},
+		{"refused", &upstream.DialError{Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, socks5ReplyRefused},
+		{"deadline", context.DeadlineExceeded, socks5ReplyTTLExpired},
+		{"network unreachable", &net.OpError{Op: "dial", Err: syscall.ENETUNREACH}, socks5ReplyNetUnreach},
+		{"host unreachable", &net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, socks5ReplyHostUnreach},
+		{"dns", &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, socks5ReplyHostUnreach},
+		{"udp not supported", upstream.ErrUDPNotSupported, socks5ReplyNoCmd},
+		{"unclassified", errors.New("boom"), socks5ReplyFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := socks5ReplyCode(tt.err); got != tt.want {
+				t.Fatalf("expected reply %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func buildSocks5UDPHeader(from *net.UDPAddr) []byte {
+	return append([]byte{0x00, 0x00, 0x00}, encodeSocks5Addr(from)...)
+}
+
+func TestSocks5UDPHeaderRoundTrip(t *testing.T) {
+	from := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53}
+	packet := append(buildSocks5UDPHeader(from), "payload"...)
+
+	addr, payload, err := parseSocks5UDPHeader(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "10.0.0.1:53" {
+		t.Fatalf("unexpected addr %s", addr)
+	}
+	if string(payload) != "payload" {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+}
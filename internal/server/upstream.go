@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/stickpro/p-router/internal/metrics"
+	"github.com/stickpro/p-router/internal/router"
+	"github.com/stickpro/p-router/internal/upstream"
+)
+
+// Option configures the proxy listeners.
+type Option func(*upstreamDialer)
+
+// WithFailover lets pooled users retry on other upstreams: at most maxAttempts
+// upstreams are tried within budget. maxAttempts below 2 disables failover.
+func WithFailover(maxAttempts int, budget time.Duration) Option {
+	return func(d *upstreamDialer) {
+		d.maxAttempts = maxAttempts
+		d.budget = budget
+	}
+}
+
+// WithMetrics records tunnels, requests, dials and traffic in m.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(d *upstreamDialer) {
+		d.metrics = m
+	}
+}
+
+// upstreamDialer connects clients to their upstream, failing over to other
+// upstreams of the same credentials and reporting broken ones to the router.
+type upstreamDialer struct {
+	router      *router.ProxyRouter
+	maxAttempts int
+	budget      time.Duration
+	limiter     *Limiter
+	meter       *Meter
+	metrics     *metrics.Metrics
+}
+
+func newUpstreamDialer(r *router.ProxyRouter, opts ...Option) *upstreamDialer {
+	d := &upstreamDialer{router: r, maxAttempts: 1}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// admit checks the rate limit and traffic quotas of creds before a request or tunnel.
+func (d *upstreamDialer) admit(creds router.Credentials) error {
+	if err := d.limiter.Allow(creds); err != nil {
+		return err
+	}
+	return d.meter.CheckQuota(creds)
+}
+
+type dialFunc func(ctx context.Context, config *router.ProxyConfig) (net.Conn, error)
+
+// dial calls fn for config and, when it fails, for the next upstream picked by
+// router.Failover. It returns the metered connection with the config that
+// produced it; on failure the last error is returned.
+func (d *upstreamDialer) dial(ctx context.Context, creds router.Credentials, config *router.ProxyConfig, fn dialFunc) (net.Conn, *router.ProxyConfig, error) {
+	if d.budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.budget)
+		defer cancel()
+	}
+
+	var tried []string
+	for {
+		start := time.Now()
+		conn, err := fn(ctx, config)
+		d.metrics.Dial(config.Username, time.Since(start), err)
+		if err == nil {
+			d.router.ReportSuccess(config.Username)
+			return d.count(conn, creds, config), config, nil
+		}
+
+		// The client went away, the budget ran out or the client asked for
+		// something the upstream cannot do, the upstream is not to blame.
+		if ctx.Err() != nil || errors.Is(err, upstream.ErrUDPNotSupported) {
+			return nil, config, err
+		}
+
+		// A refused destination is still retried elsewhere, but the upstream
+		// that refused it keeps working.
+		if !blamesDestination(err) {
+			d.router.ReportFailure(config.Username)
+		}
+
+		tried = append(tried, config.Username)
+		if len(tried) >= d.maxAttempts {
+			return nil, config, err
+		}
+
+		next, nextErr := d.router.Failover(creds, tried)
+		if nextErr != nil {
+			return nil, config, err
+		}
+		config = next
+	}
+}
+
+// blamesDestination reports whether err is an upstream refusing or failing to
+// reach the destination. The upstream answered, so it is working; only its
+// own failures, such as rejected credentials, count against it.
+func blamesDestination(err error) bool {
+	var statusErr *upstream.StatusError
+	return errors.As(err, &statusErr) && statusErr.Destination
+}
+
+// count reports the traffic of conn to the usage meter and metrics.
+func (d *upstreamDialer) count(conn net.Conn, creds router.Credentials, config *router.ProxyConfig) net.Conn {
+	if d.meter == nil && d.metrics == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, count: d.counter(creds, config)}
+}
+
+// counter returns a function reporting traffic of creds through the upstream
+// of config to the usage meter and metrics.
+func (d *upstreamDialer) counter(creds router.Credentials, config *router.ProxyConfig) func(up, down int64) {
+	username, _ := d.router.UserLimits(creds)
+	return func(up, down int64) {
+		d.meter.add(username, config.Username, up, down)
+		d.metrics.Transferred(up, down)
+	}
+}
+
+// countingConn reports the bytes written to the upstream as up and the bytes
+// read from it as down.
+type countingConn struct {
+	net.Conn
+	count func(up, down int64)
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.count(0, int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.count(int64(n), 0)
+	}
+	return n, err
+}
+
+// dialUpstream opens a tunnel to addr through the upstream proxy of config.
+func dialUpstream(ctx context.Context, config *router.ProxyConfig, addr string) (net.Conn, error) {
+	proxy, err := config.Upstream()
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy.Dial(ctx, addr)
+}
+
+// dialForward opens a connection suitable for writing a plain HTTP request to.
+// HTTP proxies receive the request in absolute form, SOCKS proxies get a tunnel
+// to the origin server.
+func dialForward(ctx context.Context, config *router.ProxyConfig, r *http.Request) (net.Conn, error) {
+	proxy, err := config.Upstream()
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy.IsHTTP() {
+		return proxy.DialProxy(ctx)
+	}
+
+	addr := r.URL.Host
+	if addr == "" {
+		addr = r.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+
+	return proxy.Dial(ctx, addr)
+}
+
+// writeUpstreamError maps a dialUpstream error to the HTTP response sent to the client.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	var (
+		statusErr *upstream.StatusError
+		dialErr   *upstream.DialError
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		http.Error(w, fmt.Sprintf("Proxy returned: %s", statusErr.Status), statusErr.StatusCode)
+	case errors.As(err, &dialErr):
+		http.Error(w, fmt.Sprintf("Cannot connect to proxy: %v", dialErr.Err), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
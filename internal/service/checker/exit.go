@@ -0,0 +1,141 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+const maxEchoBodySize = 64 << 10
+
+// proxyHeaders reveal to the target that a request went through a proxy.
+var proxyHeaders = []string{
+	"Via",
+	"X-Forwarded-For",
+	"Forwarded",
+	"X-Real-Ip",
+	"X-Client-Ip",
+	"Client-Ip",
+	"X-Proxy-Id",
+	"Proxy-Connection",
+}
+
+// echoResponse is the JSON reply of an echo endpoint such as httpbin's
+// /anything: the client address as "ip" or "origin" and the received headers.
+type echoResponse struct {
+	IP      string         `json:"ip"`
+	Origin  string         `json:"origin"`
+	Headers map[string]any `json:"headers"`
+}
+
+// echo requests the echo endpoint and returns the client IP it saw and the
+// headers it received. Endpoints that reply with a bare IP return nil headers.
+func echo(ctx context.Context, client *http.Client, url string) (net.IP, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create echo request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("echo request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected echo status code: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxEchoBodySize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read echo response: %w", err)
+	}
+
+	var reply echoResponse
+	if err := json.Unmarshal(body, &reply); err != nil {
+		ip := net.ParseIP(strings.TrimSpace(string(body)))
+		if ip == nil {
+			return nil, nil, fmt.Errorf("echo response has no IP")
+		}
+		return ip, nil, nil
+	}
+
+	// A chain such as "client, proxy" ends with the address that connected.
+	origin := reply.IP
+	if origin == "" {
+		origin = reply.Origin
+	}
+	if i := strings.LastIndex(origin, ","); i >= 0 {
+		origin = origin[i+1:]
+	}
+	ip := net.ParseIP(strings.TrimSpace(origin))
+	if ip == nil {
+		return nil, nil, fmt.Errorf("echo response has no IP")
+	}
+
+	headers := make(http.Header, len(reply.Headers))
+	for key, value := range reply.Headers {
+		switch v := value.(type) {
+		case string:
+			headers.Add(key, v)
+		case []any:
+			for _, item := range v {
+				headers.Add(key, fmt.Sprint(item))
+			}
+		}
+	}
+
+	return ip, headers, nil
+}
+
+// classifyAnonymity tells from the headers the echo endpoint received through
+// a proxy whether the proxy leaked realIP or its own presence. It returns an
+// empty level when the headers are unknown.
+func classifyAnonymity(headers http.Header, realIP net.IP) string {
+	if headers == nil {
+		return ""
+	}
+
+	anonymity := repository.AnonymityElite
+	for _, name := range proxyHeaders {
+		values := headers.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		anonymity = repository.AnonymityAnonymous
+		if realIP != nil && strings.Contains(strings.Join(values, ","), realIP.String()) {
+			return repository.AnonymityTransparent
+		}
+	}
+	return anonymity
+}
+
+// detectExit finds the exit IP of the upstream behind client, its anonymity
+// compared to realIP, and where the exit is located.
+func (s *Service) detectExit(ctx context.Context, client *http.Client, realIP net.IP) (*repository.ExitInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultProbeTimeout)
+	defer cancel()
+
+	ip, headers, err := echo(ctx, client, s.conf.Checker.EchoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &repository.ExitInfo{
+		IP:        ip.String(),
+		Anonymity: classifyAnonymity(headers, realIP),
+	}
+
+	info.Country, info.ASN, info.ASOrg, err = s.geoip.Lookup(ip)
+	if err != nil {
+		return nil, fmt.Errorf("geoip lookup failed: %w", err)
+	}
+
+	return info, nil
+}
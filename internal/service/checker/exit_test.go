@@ -0,0 +1,66 @@
+package checker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+func TestEchoAndAnonymity(t *testing.T) {
+	realIP := net.ParseIP("198.51.100.7")
+
+	tests := []struct {
+		name      string
+		body      string
+		ip        string
+		anonymity string
+	}{
+		{
+			name:      "transparent",
+			body:      `{"origin": "198.51.100.7, 203.0.113.1", "headers": {"X-Forwarded-For": "198.51.100.7"}}`,
+			ip:        "203.0.113.1",
+			anonymity: repository.AnonymityTransparent,
+		},
+		{
+			name:      "anonymous",
+			body:      `{"origin": "203.0.113.1", "headers": {"Via": "1.1 squid"}}`,
+			ip:        "203.0.113.1",
+			anonymity: repository.AnonymityAnonymous,
+		},
+		{
+			name:      "elite",
+			body:      `{"ip": "203.0.113.1", "headers": {"Accept": ["*/*"]}}`,
+			ip:        "203.0.113.1",
+			anonymity: repository.AnonymityElite,
+		},
+		{
+			name: "bare ip",
+			body: "203.0.113.1\n",
+			ip:   "203.0.113.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			ip, headers, err := echo(context.Background(), srv.Client(), srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip.String() != tt.ip {
+				t.Fatalf("expected ip %s, got %s", tt.ip, ip)
+			}
+			if got := classifyAnonymity(headers, realIP); got != tt.anonymity {
+				t.Fatalf("expected anonymity %q, got %q", tt.anonymity, got)
+			}
+		})
+	}
+}
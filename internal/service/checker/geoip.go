@@ -0,0 +1,88 @@
+package checker
+
+import (
+	"errors"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP resolves exit IPs with offline MaxMind databases: a GeoIP2 or
+// GeoLite2 Country/City database and an ASN database. Either may be missing.
+type GeoIP struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// OpenGeoIP opens the databases at the given paths, skipping empty ones.
+func OpenGeoIP(countryPath, asnPath string) (*GeoIP, error) {
+	g := &GeoIP{}
+
+	if countryPath != "" {
+		reader, err := maxminddb.Open(countryPath)
+		if err != nil {
+			return nil, err
+		}
+		g.country = reader
+	}
+
+	if asnPath != "" {
+		reader, err := maxminddb.Open(asnPath)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.asn = reader
+	}
+
+	return g, nil
+}
+
+// Lookup returns the country code, AS number and AS organization of ip.
+// Values missing from the databases are left empty.
+func (g *GeoIP) Lookup(ip net.IP) (string, uint, string, error) {
+	if g == nil {
+		return "", 0, "", nil
+	}
+
+	var (
+		country struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		asn struct {
+			Number       uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+	)
+
+	if g.country != nil {
+		if err := g.country.Lookup(ip, &country); err != nil {
+			return "", 0, "", err
+		}
+	}
+
+	if g.asn != nil {
+		if err := g.asn.Lookup(ip, &asn); err != nil {
+			return "", 0, "", err
+		}
+	}
+
+	return country.Country.ISOCode, asn.Number, asn.Organization, nil
+}
+
+func (g *GeoIP) Close() error {
+	if g == nil {
+		return nil
+	}
+
+	var errs []error
+	if g.country != nil {
+		errs = append(errs, g.country.Close())
+	}
+	if g.asn != nil {
+		errs = append(errs, g.asn.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,213 @@
+package checker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stickpro/p-router/internal/config"
+	"github.com/stickpro/p-router/internal/upstream"
+)
+
+const (
+	defaultCheckURL     = "http://www.google.com"
+	defaultProbeTimeout = 30 * time.Second
+	maxProbeBodySize    = 1 << 20
+)
+
+// ProbeResult is the outcome of one probe of a check.
+type ProbeResult struct {
+	URL        string
+	Success    bool
+	Latency    time.Duration
+	StatusCode int
+	ErrorClass string
+	Error      error
+}
+
+// probe is a probe from the configuration with its defaults applied.
+type probe struct {
+	config.ProbeConfig
+	body *regexp.Regexp
+}
+
+// probes returns the configured probes, or a single probe of CheckURL when
+// none are configured.
+func (s *Service) probes() ([]probe, error) {
+	configs := s.conf.Checker.Probes
+	if len(configs) == 0 {
+		url := s.conf.Checker.CheckURL
+		if url == "" {
+			url = defaultCheckURL
+		}
+		configs = []config.ProbeConfig{{URL: url}}
+	}
+
+	result := make([]probe, 0, len(configs))
+	for _, conf := range configs {
+		p := probe{ProbeConfig: conf}
+		if p.Method == "" {
+			p.Method = http.MethodGet
+		}
+		if p.Timeout <= 0 {
+			p.Timeout = defaultProbeTimeout
+		}
+		if p.BodyMatch != "" {
+			body, err := regexp.Compile(p.BodyMatch)
+			if err != nil {
+				return nil, fmt.Errorf("invalid body_match of probe %s: %w", p.URL, err)
+			}
+			p.body = body
+		}
+		result = append(result, p)
+	}
+
+	return result, nil
+}
+
+// quorum returns how many of n probes must pass.
+func (s *Service) quorum(n int) int {
+	if q := s.conf.Checker.Quorum; q > 0 && q < n {
+		return q
+	}
+	return n
+}
+
+func (p *probe) expects(status int) bool {
+	if len(p.ExpectStatus) == 0 {
+		return status >= 200 && status < 400
+	}
+	return slices.Contains(p.ExpectStatus, status)
+}
+
+// run sends the probe request with client and checks the response.
+func (s *Service) run(ctx context.Context, client *http.Client, p probe) ProbeResult {
+	result := ProbeResult{URL: p.URL}
+
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, p.Method, p.URL, nil)
+	if err != nil {
+		result.Error = fmt.Errorf("failed to create request: %w", err)
+		result.ErrorClass = ErrorClassRequest
+		return result
+	}
+	if ua := s.conf.Checker.UserAgent; ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = fmt.Errorf("http request failed: %w", err)
+		result.ErrorClass = ErrorClassRequest
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+			result.ErrorClass = ErrorClassTimeout
+		}
+		result.Latency = time.Since(start)
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.Latency = time.Since(start)
+	result.StatusCode = resp.StatusCode
+
+	if !p.expects(resp.StatusCode) {
+		result.Error = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		result.ErrorClass = ErrorClassStatus
+		return result
+	}
+
+	if p.body != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBodySize))
+		if err != nil {
+			result.Error = fmt.Errorf("failed to read body: %w", err)
+			result.ErrorClass = ErrorClassRequest
+			return result
+		}
+		if !p.body.Match(body) {
+			result.Error = fmt.Errorf("body does not match %q", p.BodyMatch)
+			result.ErrorClass = ErrorClassBody
+			return result
+		}
+	}
+
+	result.Success = true
+	return result
+}
+
+// probeClients builds the HTTP clients that send probes through an upstream,
+// one that sends plain requests and one that tunnels them with CONNECT. SOCKS
+// upstreams always tunnel.
+type probeClients struct {
+	proxy   *upstream.Proxy
+	clients map[bool]*http.Client
+}
+
+func newProbeClients(proxy *upstream.Proxy) *probeClients {
+	return &probeClients{proxy: proxy, clients: make(map[bool]*http.Client)}
+}
+
+func (c *probeClients) get(connect bool) *http.Client {
+	if !c.proxy.IsHTTP() {
+		connect = true
+	}
+	if client, exists := c.clients[connect]; exists {
+		return client
+	}
+
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if !connect {
+		transport.Proxy = http.ProxyURL(c.proxy.URL())
+	} else {
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return c.proxy.Dial(ctx, addr)
+		}
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	c.clients[connect] = client
+	return client
+}
+
+func (c *probeClients) close() {
+	for _, client := range c.clients {
+		client.CloseIdleConnections()
+	}
+}
+
+// describeProbes summarizes failed probes for the check error.
+func describeProbes(results []ProbeResult) string {
+	var failed []string
+	for _, result := range results {
+		if !result.Success {
+			failed = append(failed, fmt.Sprintf("%s: %v", result.URL, result.Error))
+		}
+	}
+	return strings.Join(failed, "; ")
+}
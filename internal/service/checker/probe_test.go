@@ -0,0 +1,71 @@
+package checker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stickpro/p-router/internal/config"
+	"github.com/stickpro/p-router/internal/repository"
+)
+
+func TestProbeQuorum(t *testing.T) {
+	// The test server plays both the upstream proxy and the origin.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			_, _ = w.Write([]byte("hello world"))
+		case "/teapot":
+			w.WriteHeader(http.StatusTeapot)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(proxy.Close)
+
+	tests := []struct {
+		name       string
+		probes     []config.ProbeConfig
+		quorum     int
+		success    bool
+		ran        int
+		errorClass string
+	}{
+		{name: "quorum reached early", probes: []config.ProbeConfig{{URL: "http://origin/ok"}, {URL: "http://origin/missing"}}, quorum: 1, success: true, ran: 1},
+		{name: "quorum missed early", probes: []config.ProbeConfig{{URL: "http://origin/missing"}, {URL: "http://origin/ok"}}, success: false, ran: 1, errorClass: ErrorClassStatus},
+		{name: "all pass", probes: []config.ProbeConfig{
+			{URL: "http://origin/ok", BodyMatch: "hello world"},
+			{URL: "http://origin/ok", Method: http.MethodHead, BodyMatch: "^$"},
+			{URL: "http://origin/teapot", ExpectStatus: []int{http.StatusTeapot}},
+		}, success: true, ran: 3},
+		{name: "body mismatch", probes: []config.ProbeConfig{
+			{URL: "http://origin/teapot", ExpectStatus: []int{http.StatusTeapot}},
+			{URL: "http://origin/ok", BodyMatch: "^bye"},
+		}, quorum: 2, success: false, ran: 2, errorClass: ErrorClassBody},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &config.Config{}
+			conf.Checker.Quorum = tt.quorum
+			conf.Checker.Probes = tt.probes
+
+			s := New(conf, nil, nil)
+			probes, err := s.probes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := s.checkSingleProxy(context.Background(), &repository.ProxyModel{
+				Username: "user",
+				Target:   proxy.Listener.Addr().String(),
+			}, probes, nil)
+
+			if result.Success != tt.success || len(result.Probes) != tt.ran || result.ErrorClass != tt.errorClass {
+				t.Fatalf("unexpected result: success %v, %d probes, class %q, error %v",
+					result.Success, len(result.Probes), result.ErrorClass, result.Error)
+			}
+		})
+	}
+}
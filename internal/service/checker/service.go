@@ -5,30 +5,77 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"net/url"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/stickpro/p-router/internal/config"
 	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/upstream"
 	"github.com/stickpro/p-router/pkg/logger"
 	"go.uber.org/zap"
 )
 
+// Policies for proxies that exceed the maximum of failed checks.
+const (
+	DeadPolicyQuarantine = "quarantine"
+	DeadPolicyDelete     = "delete"
+)
+
 type ICheckerService interface {
 	Check(ctx context.Context) error
 	StartPeriodicCheck(ctx context.Context, interval time.Duration)
 }
 
 type Service struct {
-	conf   *config.Config
-	l      logger.Logger
-	repo   repository.IProxyRepository
-	client *http.Client
+	conf      *config.Config
+	l         logger.Logger
+	repo      repository.IProxyRepository
+	client    *http.Client
+	observers []func(CheckResult)
+	deleted   []func(username string)
+
+	statusObservers []func(username, status string)
+
+	geoip *GeoIP
+}
+
+type Option func(*Service)
+
+// WithObserver registers a function called with every check result,
+// e.g. to keep the router's view of upstream health current.
+func WithObserver(fn func(CheckResult)) Option {
+	return func(s *Service) {
+		s.observers = append(s.observers, fn)
+	}
+}
+
+// WithDeleteObserver registers a function called with every proxy deleted
+// after exceeding the maximum of failed checks.
+func WithDeleteObserver(fn func(username string)) Option {
+	return func(s *Service) {
+		s.deleted = append(s.deleted, fn)
+	}
+}
+
+// WithStatusObserver registers a function called whenever a check moves a
+// proxy to another status.
+func WithStatusObserver(fn func(username, status string)) Option {
+	return func(s *Service) {
+		s.statusObservers = append(s.statusObservers, fn)
+	}
 }
 
-func New(conf *config.Config, l logger.Logger, repo repository.IProxyRepository) *Service {
-	return &Service{
+// WithGeoIP resolves the country and ASN of exit IPs with g.
+func WithGeoIP(g *GeoIP) Option {
+	return func(s *Service) {
+		s.geoip = g
+	}
+}
+
+func New(conf *config.Config, l logger.Logger, repo repository.IProxyRepository, opts ...Option) *Service {
+	s := &Service{
 		conf: conf,
 		l:    l,
 		repo: repo,
@@ -39,33 +86,132 @@ func New(conf *config.Config, l logger.Logger, repo repository.IProxyRepository)
 			},
 		},
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
+// Error classes of failed checks, kept in the check history.
+const (
+	ErrorClassTarget  = "target"
+	ErrorClassConnect = "connect"
+	ErrorClassRequest = "request"
+	ErrorClassTimeout = "timeout"
+	ErrorClassStatus  = "status"
+	ErrorClassBody    = "body"
+)
+
 type CheckResult struct {
-	Username string
-	Success  bool
-	Latency  time.Duration
-	Error    error
+	Username   string
+	Target     string
+	Success    bool
+	Latency    time.Duration
+	StatusCode int
+	ErrorClass string
+	Error      error
+
+	// Probes holds the probes run until the quorum was reached or missed.
+	Probes []ProbeResult
+
+	// Exit is set when a successful check also reached the echo endpoint.
+	Exit *repository.ExitInfo
 }
 
 func (s *Service) Check(ctx context.Context) error {
-	proxies, err := s.repo.FindAll()
+	probes, err := s.probes()
+	if err != nil {
+		return err
+	}
+
+	proxies, err := s.repo.FindAll(ctx)
 	if err != nil {
 		s.l.Error("failed to fetch proxies", err)
 		return fmt.Errorf("failed to fetch proxies: %w", err)
 	}
 
+	proxies, skipped := s.due(proxies)
 	if len(proxies) == 0 {
-		s.l.Info("no proxies to check")
+		s.l.Info("no proxies to check", zap.Int("skipped", skipped))
 		return nil
 	}
 
+	s.checkProxies(ctx, proxies, probes, false)
+
+	if retention := s.conf.Checker.HistoryRetention; retention > 0 {
+		pruned, err := s.repo.PruneChecks(ctx, time.Now().Add(-retention))
+		if err != nil {
+			s.l.Error("failed to prune check history", err)
+		} else if pruned > 0 {
+			s.l.Infow("pruned check history", "deleted", pruned)
+		}
+	}
+
+	return nil
+}
+
+// CheckOptions selects the proxies checked by CheckSelected. Empty usernames
+// and target select all proxies.
+type CheckOptions struct {
+	Usernames []string
+	// Target keeps the proxies whose target contains it.
+	Target string
+	// DryRun reports results without storing them, changing statuses or deleting proxies.
+	DryRun bool
+}
+
+// CheckSelected checks the selected proxies once and returns the results
+// ordered by username. Disabled proxies are only checked when named in
+// Usernames, other proxies whatever their status.
+func (s *Service) CheckSelected(ctx context.Context, opts CheckOptions) ([]CheckResult, error) {
+	probes, err := s.probes()
+	if err != nil {
+		return nil, err
+	}
+
+	proxies, err := s.repo.FindAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch proxies: %w", err)
+	}
+
+	proxies = slices.DeleteFunc(proxies, func(proxy *repository.ProxyModel) bool {
+		named := slices.Contains(opts.Usernames, proxy.Username)
+		return (len(opts.Usernames) > 0 && !named) ||
+			(proxy.Status == repository.StatusDisabled && !named) ||
+			!strings.Contains(proxy.Target, opts.Target)
+	})
+
+	results := s.checkProxies(ctx, proxies, probes, opts.DryRun)
+	slices.SortFunc(results, func(a, b CheckResult) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return results, nil
+}
+
+// checkProxies checks proxies concurrently and, unless dryRun is set, records
+// the results and moves the proxies to the status they earned.
+func (s *Service) checkProxies(ctx context.Context, proxies []*repository.ProxyModel, probes []probe, dryRun bool) []CheckResult {
 	s.l.Info("starting proxy check", zap.Int("count", len(proxies)))
 
+	var realIP net.IP
+	if s.conf.Checker.EchoURL != "" {
+		var err error
+		realIP, _, err = echo(ctx, s.client, s.conf.Checker.EchoURL)
+		if err != nil {
+			s.l.Warnw("failed to detect own IP, transparent proxies cannot be told apart", "error", err)
+		}
+	}
+
 	resultChan := make(chan CheckResult, len(proxies))
 	var wg sync.WaitGroup
 
-	semaphore := make(chan struct{}, 10)
+	concurrency := s.conf.Checker.Concurrency
+	if concurrency <= 0 {
+		concurrency = 10
+	}
+	semaphore := make(chan struct{}, concurrency)
 
 	for _, proxy := range proxies {
 		wg.Add(1)
@@ -75,7 +221,7 @@ func (s *Service) Check(ctx context.Context) error {
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
 
-			result := s.checkSingleProxy(ctx, p)
+			result := s.checkSingleProxy(ctx, p, probes, realIP)
 			resultChan <- result
 		}(proxy)
 	}
@@ -88,156 +234,269 @@ func (s *Service) Check(ctx context.Context) error {
 	successCount := 0
 	failedCount := 0
 
+	results := make([]CheckResult, 0, len(proxies))
 	for result := range resultChan {
+		results = append(results, result)
+
+		for _, observe := range s.observers {
+			observe(result)
+		}
+
 		if result.Success {
 			successCount++
 			s.l.Infow("proxy check successful",
 				"username", result.Username,
 				"latency", result.Latency,
 			)
-
-			if err := s.repo.ResetFailedChecks(result.Username); err != nil {
-				s.l.Errorw("failed to reset failed checks",
-					"username", result.Username,
-					err,
-				)
-			}
 		} else {
 			failedCount++
 			s.l.Warnln("proxy check failed",
 				"username", result.Username,
 				result.Error,
 			)
+		}
 
-			if err := s.repo.IncrementFailedChecks(result.Username); err != nil {
-				s.l.Error("failed to increment failed checks",
-					"username", result.Username,
-					err,
-				)
-				continue
-			}
+		if !dryRun {
+			s.record(ctx, result)
+		}
+	}
 
-			proxy, err := s.repo.FindByUsername(result.Username)
-			if err != nil {
-				continue
-			}
+	s.l.Infow("proxy check completed",
+		"total", len(proxies),
+		"success", successCount,
+		"failed", failedCount,
+	)
 
-			if proxy == nil {
-				continue
+	return results
+}
+
+// record stores a check result and applies its consequences to the proxy,
+// leaving the status of disabled proxies alone. The check, the counters, the status change or deletion they lead to and the
+// exit info are written in one transaction, so that they act on the state the check
+// left rather than on one changed in between, e.g. by the router.
+func (s *Service) record(ctx context.Context, result CheckResult) {
+	var (
+		status  string
+		deleted bool
+	)
+	err := s.repo.WithTx(ctx, func(tx repository.IProxyStore) error {
+		if err := tx.AddCheck(ctx, &repository.CheckModel{
+			Username:   result.Username,
+			CheckedAt:  time.Now(),
+			Success:    result.Success,
+			Latency:    result.Latency,
+			StatusCode: result.StatusCode,
+			ErrorClass: result.ErrorClass,
+		}); err != nil {
+			return fmt.Errorf("failed to record check: %w", err)
+		}
+
+		proxy, err := tx.RecordCheckResult(ctx, result.Username, result.Success)
+		if err != nil {
+			return fmt.Errorf("failed to record check result: %w", err)
+		}
+
+		if result.Success && result.Exit != nil {
+			if err := tx.SetExitInfo(ctx, result.Username, *result.Exit); err != nil {
+				return fmt.Errorf("failed to store exit info: %w", err)
 			}
+		}
+
+		// Disabled proxies are only ever enabled by an operator.
+		if proxy.Status == repository.StatusDisabled {
+			return nil
+		}
 
+		if result.Success {
+			if proxy.Status != repository.StatusActive {
+				s.l.Infow("proxy passed check - reviving",
+					"username", result.Username,
+					"status", proxy.Status,
+				)
+				status = repository.StatusActive
+			}
+		} else {
 			s.l.Warnw("proxy failed checks updated",
 				"username", result.Username,
 				"failed_checks", proxy.FailedChecks,
 			)
 
-			maxFailedChecks := s.conf.Checker.MaxFailedChecks
-			if maxFailedChecks == 0 {
-				maxFailedChecks = 5
+			status, deleted = s.verdict(proxy)
+			if deleted {
+				if err := tx.Delete(ctx, result.Username); err != nil {
+					return fmt.Errorf("failed to delete proxy: %w", err)
+				}
 			}
+		}
 
-			if proxy.FailedChecks >= maxFailedChecks {
-				s.l.Errorw("proxy exceeded max failed checks - deleting",
-					"username", result.Username,
-					"target", proxy.Target,
-					"failed_checks", proxy.FailedChecks,
-					"max_allowed", maxFailedChecks,
-				)
-
-				if err := s.repo.Delete(result.Username); err != nil {
-					s.l.Error("failed to delete proxy",
-						zap.String("username", result.Username),
-						err,
-					)
-				} else {
-					s.l.Info("proxy deleted successfully",
-						zap.String("username", result.Username),
-					)
-				}
+		if status != "" {
+			if err := tx.SetStatus(ctx, result.Username, status); err != nil {
+				return fmt.Errorf("failed to set proxy status: %w", err)
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		s.l.Errorw("failed to apply check result",
+			"username", result.Username,
+			err,
+		)
+		return
 	}
 
-	s.l.Infow("proxy check completed",
-		"total", len(proxies),
-		"success", successCount,
-		"failed", failedCount,
-	)
+	if deleted {
+		s.l.Info("proxy deleted successfully",
+			zap.String("username", result.Username),
+		)
+		for _, observe := range s.deleted {
+			observe(result.Username)
+		}
+	}
+	if status != "" {
+		for _, observe := range s.statusObservers {
+			observe(result.Username, status)
+		}
+	}
+}
 
-	return nil
+// verdict returns the status a proxy that just failed a check moves to, or
+// whether it is to be deleted. An empty status keeps the current one.
+func (s *Service) verdict(proxy *repository.ProxyModel) (status string, deleted bool) {
+	maxFailedChecks := s.conf.Checker.MaxFailedChecks
+	if maxFailedChecks == 0 {
+		maxFailedChecks = 5
+	}
+
+	switch {
+	case proxy.FailedChecks < maxFailedChecks:
+		if proxy.Status == repository.StatusActive {
+			return repository.StatusDegraded, false
+		}
+	case s.conf.Checker.DeadPolicy == DeadPolicyDelete:
+		s.l.Errorw("proxy exceeded max failed checks - deleting",
+			"username", proxy.Username,
+			"target", proxy.Target,
+			"failed_checks", proxy.FailedChecks,
+			"max_allowed", maxFailedChecks,
+		)
+		return "", true
+	case proxy.Status != repository.StatusQuarantined:
+		s.l.Errorw("proxy exceeded max failed checks - quarantining",
+			"username", proxy.Username,
+			"target", proxy.Target,
+			"failed_checks", proxy.FailedChecks,
+			"max_allowed", maxFailedChecks,
+		)
+		return repository.StatusQuarantined, false
+	}
+	return "", false
+}
+
+// due drops disabled proxies and quarantined ones checked within the
+// quarantine interval, and returns the rest with the number dropped.
+func (s *Service) due(proxies []*repository.ProxyModel) ([]*repository.ProxyModel, int) {
+	result := make([]*repository.ProxyModel, 0, len(proxies))
+	for _, proxy := range proxies {
+		switch proxy.Status {
+		case repository.StatusDisabled:
+			continue
+		case repository.StatusQuarantined:
+			if checkedAt, ok := parseCheckTime(proxy.LastCheckAt); ok && time.Since(checkedAt) < s.conf.Checker.QuarantineInterval {
+				continue
+			}
+		}
+		result = append(result, proxy)
+	}
+	return result, len(proxies) - len(result)
+}
+
+func parseCheckTime(value string) (time.Time, bool) {
+	for _, layout := range []string{time.DateTime, time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
 }
 
-func (s *Service) checkSingleProxy(ctx context.Context, proxy *repository.ProxyModel) CheckResult {
+// checkSingleProxy runs the probes through proxy until the quorum is reached
+// or can no longer be. The latency of a passed check is the mean latency of
+// its passed probes.
+func (s *Service) checkSingleProxy(ctx context.Context, proxy *repository.ProxyModel, probes []probe, realIP net.IP) CheckResult {
 	result := CheckResult{
 		Username: proxy.Username,
+		Target:   proxy.Target,
 		Success:  false,
 	}
 
 	start := time.Now()
 
-	if !s.checkTCPConnection(ctx, proxy.Target) {
-		result.Error = fmt.Errorf("tcp connection failed")
+	upstreamProxy, err := upstream.ParseWithAuth(proxy.Target, proxy.UpstreamUsername, proxy.UpstreamPassword)
+	if err != nil {
+		result.Error = err
+		result.ErrorClass = ErrorClassTarget
 		result.Latency = time.Since(start)
 		return result
 	}
 
-	testURL := s.conf.Checker.CheckURL
-	if testURL == "" {
-		testURL = "http://www.google.com"
-	}
-
-	proxyURL, err := url.Parse(fmt.Sprintf("http://%s", proxy.Target))
-	if err != nil {
-		result.Error = fmt.Errorf("invalid proxy URL: %w", err)
+	if !s.checkTCPConnection(ctx, upstreamProxy.Addr) {
+		result.Error = fmt.Errorf("tcp connection failed")
+		result.ErrorClass = ErrorClassConnect
 		result.Latency = time.Since(start)
 		return result
 	}
 
-	transport := &http.Transport{
-		Proxy: http.ProxyURL(proxyURL),
-		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   30 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
+	clients := newProbeClients(upstreamProxy)
+	defer clients.close()
+
+	quorum := s.quorum(len(probes))
+	passed, failed := 0, 0
+	var latency time.Duration
+	var firstFailure *ProbeResult
+	for _, p := range probes {
+		probeResult := s.run(ctx, clients.get(p.Connect), p)
+		result.Probes = append(result.Probes, probeResult)
+
+		if probeResult.Success {
+			passed++
+			latency += probeResult.Latency
+			if result.StatusCode == 0 {
+				result.StatusCode = probeResult.StatusCode
+			}
+		} else {
+			failed++
+			if firstFailure == nil {
+				firstFailure = &probeResult
+			}
+		}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", testURL, nil)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to create request: %w", err)
-		result.Latency = time.Since(start)
-		return result
+		if passed >= quorum || failed > len(probes)-quorum {
+			break
+		}
 	}
 
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_6_6; en-US) AppleWebKit/602.37 (KHTML, like Gecko) Chrome/50.0.2869.109 Safari/602")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		result.Error = fmt.Errorf("http request failed: %w", err)
+	if passed < quorum {
+		result.StatusCode = firstFailure.StatusCode
+		result.ErrorClass = firstFailure.ErrorClass
+		result.Error = fmt.Errorf("%d of %d probes passed, %d required: %s", passed, len(probes), quorum, describeProbes(result.Probes))
 		result.Latency = time.Since(start)
 		return result
 	}
-	defer resp.Body.Close()
 
-	result.Latency = time.Since(start)
+	result.Success = true
+	result.Latency = latency / time.Duration(passed)
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
-		result.Success = true
-		return result
+	if s.conf.Checker.EchoURL != "" {
+		exit, err := s.detectExit(ctx, clients.get(false), realIP)
+		if err != nil {
+			s.l.Warnw("exit detection failed",
+				"username", proxy.Username,
+				"error", err,
+			)
+		}
+		result.Exit = exit
 	}
 
-	result.Error = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	return result
 }
 
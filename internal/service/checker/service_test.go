@@ -0,0 +1,158 @@
+package checker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stickpro/p-router/internal/config"
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/pkg/logger"
+)
+
+func TestCheckSelected(t *testing.T) {
+	ctx := context.Background()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(proxy.Close)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	repo, err := repository.NewSQLiteRepository(filepath.Join(t.TempDir(), "proxies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	for username, target := range map[string]string{"up": proxy.Listener.Addr().String(), "down": down, "other": "127.0.0.1:1"} {
+		if _, err := repo.Create(ctx, &repository.ProxyModel{Username: username, Password: "x", Target: target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := &config.Config{}
+	conf.Checker.CheckURL = "http://origin/"
+	s := New(conf, logger.ForTests(t), repo)
+
+	results, err := s.CheckSelected(ctx, CheckOptions{Usernames: []string{"up", "down"}, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Username != "down" || results[0].Success || !results[1].Success {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	model, err := repo.FindByUsername(ctx, "down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks, err := repo.FindChecks(ctx, "", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.FailedChecks != 0 || len(checks) != 0 {
+		t.Fatalf("dry run stored results: %d failed checks, %d checks", model.FailedChecks, len(checks))
+	}
+
+	results, err = s.CheckSelected(ctx, CheckOptions{Target: down})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Username != "down" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	model, err = repo.FindByUsername(ctx, "down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.FailedChecks != 1 || model.Status != repository.StatusDegraded {
+		t.Fatalf("expected a recorded failure, got %d failed checks, status %s", model.FailedChecks, model.Status)
+	}
+
+	// Disabled proxies are skipped unless named, and stay disabled.
+	if err := repo.SetStatus(ctx, "up", repository.StatusDisabled); err != nil {
+		t.Fatal(err)
+	}
+	if results, err = s.CheckSelected(ctx, CheckOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if slices.ContainsFunc(results, func(result CheckResult) bool { return result.Username == "up" }) {
+		t.Fatalf("disabled proxy checked: %+v", results)
+	}
+	if results, err = s.CheckSelected(ctx, CheckOptions{Usernames: []string{"up"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !results[0].Success {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if model, err = repo.FindByUsername(ctx, "up"); err != nil {
+		t.Fatal(err)
+	}
+	if model.Status != repository.StatusDisabled {
+		t.Fatalf("check changed a disabled proxy to %s", model.Status)
+	}
+}
+
+func TestRecordDeadPolicy(t *testing.T) {
+	ctx := context.Background()
+	for _, policy := range []string{DeadPolicyQuarantine, DeadPolicyDelete} {
+		t.Run(policy, func(t *testing.T) {
+			repo := repository.NewMemoryRepository()
+			if _, err := repo.Create(ctx, &repository.ProxyModel{Username: "p", Password: "x", Target: "127.0.0.1:1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			conf := &config.Config{}
+			conf.Checker.MaxFailedChecks = 2
+			conf.Checker.DeadPolicy = policy
+			var statuses, deleted []string
+			s := New(conf, logger.ForTests(t), repo,
+				WithStatusObserver(func(_, status string) { statuses = append(statuses, status) }),
+				WithDeleteObserver(func(username string) { deleted = append(deleted, username) }),
+			)
+
+			for range 2 {
+				s.record(ctx, CheckResult{Username: "p", ErrorClass: ErrorClassConnect})
+			}
+
+			model, err := repo.FindByUsername(ctx, "p")
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch policy {
+			case DeadPolicyQuarantine:
+				if model == nil || model.FailedChecks != 2 || model.Status != repository.StatusQuarantined ||
+					!slices.Equal(statuses, []string{repository.StatusDegraded, repository.StatusQuarantined}) {
+					t.Fatalf("expected the proxy quarantined, got %+v, statuses %v", model, statuses)
+				}
+				if checks, err := repo.FindChecks(ctx, "p", time.Time{}); err != nil || len(checks) != 2 {
+					t.Fatalf("expected 2 stored checks, got %d (%v)", len(checks), err)
+				}
+			case DeadPolicyDelete:
+				if model != nil || !slices.Equal(deleted, []string{"p"}) {
+					t.Fatalf("expected the proxy deleted, got %+v, deleted %v", model, deleted)
+				}
+			}
+
+			s.record(ctx, CheckResult{Username: "p", Success: true})
+			if model, err = repo.FindByUsername(ctx, "p"); err != nil {
+				t.Fatal(err)
+			}
+			if policy == DeadPolicyQuarantine && (model.FailedChecks != 0 || model.Status != repository.StatusActive) {
+				t.Fatalf("expected the proxy revived, got %+v", model)
+			}
+		})
+	}
+}
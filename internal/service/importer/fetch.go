@@ -0,0 +1,53 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+const maxFetchSize = 32 << 20
+
+// Fetch downloads an import file and returns it with its format, guessed
+// from the URL and then from the content type.
+func Fetch(ctx context.Context, client *http.Client, url string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch %s: unexpected status code %d", url, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", url, err)
+	}
+	if len(data) > maxFetchSize {
+		return nil, "", fmt.Errorf("%s is larger than %d bytes", url, maxFetchSize)
+	}
+
+	format := FormatOf(url)
+	if format == FormatText {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = FormatCSV
+		case "application/json":
+			format = FormatJSON
+		case "application/yaml", "application/x-yaml", "text/yaml":
+			format = FormatYAML
+		}
+	}
+
+	return data, format, nil
+}
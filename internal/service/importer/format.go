@@ -0,0 +1,228 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/stickpro/p-router/internal/upstream"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of import files.
+const (
+	FormatText = "txt"
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+var Formats = []string{FormatText, FormatCSV, FormatJSON, FormatYAML}
+
+var ErrInvalidFormat = errors.New("invalid import format")
+
+// Record is a proxy to import. Only Target is required, it takes any form
+// ParseLine accepts. Scheme is prepended to a Target without one, and the
+// upstream credentials override those in Target. Empty router credentials
+// are generated.
+type Record struct {
+	Username         string   `json:"username" yaml:"username"`
+	Password         string   `json:"password" yaml:"password"`
+	Target           string   `json:"target" yaml:"target"`
+	Scheme           string   `json:"scheme" yaml:"scheme"`
+	UpstreamUsername string   `json:"upstream_username" yaml:"upstream_username"`
+	UpstreamPassword string   `json:"upstream_password" yaml:"upstream_password"`
+	Tags             []string `json:"tags" yaml:"tags"`
+
+	// Line is the line of the record in text and CSV files, or its position
+	// in JSON and YAML lists.
+	Line int `json:"-" yaml:"-"`
+}
+
+// FormatOf guesses the format of a file or URL from its extension, plain
+// text is the default.
+func FormatOf(name string) string {
+	if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+		name = u.Path
+	}
+
+	switch strings.ToLower(path.Ext(name)) {
+	case ".csv":
+		return FormatCSV
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	}
+	return FormatText
+}
+
+// Parse reads the records of an import file.
+func Parse(r io.Reader, format string) ([]Record, error) {
+	switch format {
+	case FormatText:
+		return parseText(r)
+	case FormatCSV:
+		return parseCSV(r)
+	case FormatJSON:
+		var records []Record
+		decoder := json.NewDecoder(r)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&records); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+		}
+		return numbered(records), nil
+	case FormatYAML:
+		var records []Record
+		decoder := yaml.NewDecoder(r)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&records); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+		}
+		return numbered(records), nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown format %s", ErrInvalidFormat, format)
+}
+
+func numbered(records []Record) []Record {
+	for i := range records {
+		records[i].Line = i + 1
+	}
+	return records
+}
+
+// parseText reads one target per line, blank lines and lines starting with
+// # are skipped.
+func parseText(r io.Reader) ([]Record, error) {
+	var records []Record
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		records = append(records, Record{Target: text, Line: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return records, nil
+}
+
+var csvColumns = []string{"username", "password", "target", "scheme", "upstream_username", "upstream_password", "tags"}
+
+// parseCSV reads a CSV file whose header names the columns, in any order.
+// Only target is required. Tags are separated by spaces, commas or semicolons.
+func parseCSV(r io.Reader) ([]Record, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !slices.Contains(csvColumns, name) {
+			return nil, fmt.Errorf("%w: unknown column %q, use %s", ErrInvalidFormat, name, strings.Join(csvColumns, ", "))
+		}
+		columns[name] = i
+	}
+	if _, exists := columns["target"]; !exists {
+		return nil, fmt.Errorf("%w: no target column", ErrInvalidFormat)
+	}
+
+	var records []Record
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		get := func(name string) string {
+			if i, exists := columns[name]; exists {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		records = append(records, Record{
+			Username:         get("username"),
+			Password:         get("password"),
+			Target:           get("target"),
+			Scheme:           get("scheme"),
+			UpstreamUsername: get("upstream_username"),
+			UpstreamPassword: get("upstream_password"),
+			Tags:             splitTags(get("tags")),
+			Line:             line,
+		})
+	}
+
+	return records, nil
+}
+
+func splitTags(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == ',' || r == ';'
+	})
+}
+
+// ParseLine splits a proxy line into the upstream target and its credentials.
+// Supported forms: host:port, user:pass@host:port, host:port:user:pass, each
+// optionally prefixed with a scheme such as socks5://.
+func ParseLine(line string) (string, string, string, error) {
+	scheme := ""
+	if i := strings.Index(line, "://"); i >= 0 {
+		scheme, line = line[:i+3], line[i+3:]
+	}
+
+	var target, username, password string
+	if i := strings.LastIndex(line, "@"); i >= 0 {
+		creds := strings.SplitN(line[:i], ":", 2)
+		if len(creds) != 2 {
+			return "", "", "", fmt.Errorf("invalid credentials")
+		}
+		target, username, password = line[i+1:], creds[0], creds[1]
+	} else {
+		parts := strings.SplitN(line, ":", 4)
+		switch len(parts) {
+		case 2:
+			target = line
+		case 4:
+			target, username, password = parts[0]+":"+parts[1], parts[2], parts[3]
+		default:
+			return "", "", "", fmt.Errorf("invalid format")
+		}
+	}
+
+	target = scheme + target
+	if _, err := upstream.Parse(target); err != nil {
+		return "", "", "", err
+	}
+
+	return target, username, password, nil
+}
@@ -0,0 +1,275 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/stickpro/p-router/internal/router"
+	utils "github.com/stickpro/p-router/pkg/util"
+)
+
+// What to do with records that conflict with an existing user or target.
+const (
+	OnConflictSkip   = "skip"
+	OnConflictUpdate = "update"
+	OnConflictFail   = "fail"
+)
+
+var ConflictModes = []string{OnConflictSkip, OnConflictUpdate, OnConflictFail}
+
+// Actions taken for imported records.
+const (
+	ActionCreated = "created"
+	ActionUpdated = "updated"
+	ActionSkipped = "skipped"
+	ActionFailed  = "failed"
+)
+
+var (
+	ErrConflict            = errors.New("import conflict")
+	ErrInvalidConflictMode = errors.New("invalid conflict mode")
+)
+
+type Options struct {
+	OnConflict string
+	// DryRun reports what would be done without storing anything.
+	DryRun bool
+	// Tags are added to the tags of every record.
+	Tags []string
+}
+
+// Result is what happened to one record.
+type Result struct {
+	Line     int
+	Action   string
+	Username string
+	// Password is empty when the stored one was kept.
+	Password string
+	Target   string
+	Reason   string
+}
+
+type Report struct {
+	Results []Result
+	Created int
+	Updated int
+	Skipped int
+	Failed  int
+}
+
+// plan is a result with the proxy to create or update.
+type plan struct {
+	Result
+	proxy *router.ProxyConfig
+}
+
+// Import adds records to the router, which validates them and stores them.
+// A record conflicts when its username is taken or an existing proxy has its
+// target; with OnConflictUpdate that proxy is changed to match the record.
+// Records repeating a username or target of an earlier record are skipped.
+// With OnConflictFail nothing is stored when a record conflicts, and the
+// report comes with ErrConflict. Invalid records are reported as failed and
+// do not stop the others.
+func Import(ctx context.Context, pr *router.ProxyRouter, records []Record, opts Options) (*Report, error) {
+	if opts.OnConflict == "" {
+		opts.OnConflict = OnConflictSkip
+	}
+	switch opts.OnConflict {
+	case OnConflictSkip, OnConflictUpdate, OnConflictFail:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidConflictMode, opts.OnConflict)
+	}
+
+	proxies, err := pr.GetAllProxies()
+	if err != nil {
+		return nil, err
+	}
+	byUsername := make(map[string]*router.ProxyConfig, len(proxies))
+	byTarget := make(map[string]*router.ProxyConfig, len(proxies))
+	for _, proxy := range proxies {
+		byUsername[proxy.Username] = proxy
+		byTarget[proxy.Target] = proxy
+	}
+	pools := make(map[string]bool)
+	for _, pool := range pr.GetAllPools() {
+		pools[pool.Username] = true
+	}
+
+	seenUsernames := make(map[string]int)
+	seenTargets := make(map[string]int)
+	plans := make([]plan, 0, len(records))
+	conflicts := 0
+
+	for _, record := range records {
+		p := plan{Result: Result{Line: record.Line, Username: record.Username, Target: record.Target}}
+
+		proxy, err := resolve(record, opts.Tags)
+		if err != nil {
+			p.Action, p.Reason = ActionFailed, err.Error()
+			plans = append(plans, p)
+			continue
+		}
+		p.Target = proxy.Target
+
+		var reason string
+		if line, exists := seenTargets[proxy.Target]; exists {
+			reason = fmt.Sprintf("duplicate target of line %d", line)
+		} else if line, exists := seenUsernames[proxy.Username]; exists && proxy.Username != "" {
+			reason = fmt.Sprintf("duplicate username of line %d", line)
+		}
+		if reason != "" {
+			p.Action, p.Reason = ActionSkipped, reason
+			if opts.OnConflict == OnConflictFail {
+				p.Action = ActionFailed
+				conflicts++
+			}
+			plans = append(plans, p)
+			continue
+		}
+		seenTargets[proxy.Target] = record.Line
+		if proxy.Username != "" {
+			seenUsernames[proxy.Username] = record.Line
+		}
+
+		// Only passwords that are given or generated are reported, stored
+		// ones are hashed.
+		password := proxy.Password
+		existing, reason := conflict(proxy, byUsername, byTarget, pools)
+		switch {
+		case reason == "":
+			if proxy.Username == "" {
+				proxy.Username = utils.RandomString(8)
+			}
+			if proxy.Password == "" {
+				proxy.Password = utils.RandomString(12)
+				password = proxy.Password
+			}
+			p.Action = ActionCreated
+		case opts.OnConflict == OnConflictUpdate && existing != nil:
+			// What the record leaves out is kept, an empty password keeps
+			// the stored one.
+			proxy.Username = existing.Username
+			if proxy.UpstreamUsername == "" && proxy.UpstreamPassword == "" {
+				proxy.UpstreamUsername, proxy.UpstreamPassword = existing.UpstreamUsername, existing.UpstreamPassword
+			}
+			if len(proxy.Tags) == 0 {
+				proxy.Tags = existing.Tags
+			}
+			p.Action, p.Reason = ActionUpdated, reason
+		case opts.OnConflict == OnConflictSkip:
+			p.Action, p.Reason = ActionSkipped, reason
+		default:
+			p.Action, p.Reason = ActionFailed, reason
+			if opts.OnConflict == OnConflictFail {
+				conflicts++
+			}
+		}
+
+		p.Username, p.Password, p.proxy = proxy.Username, password, proxy
+		plans = append(plans, p)
+	}
+
+	if conflicts > 0 {
+		for i := range plans {
+			if plans[i].Action == ActionCreated || plans[i].Action == ActionUpdated {
+				plans[i].Action, plans[i].Reason = ActionSkipped, "not imported, other records conflict"
+			}
+		}
+	}
+
+	if !opts.DryRun {
+		for i := range plans {
+			p := &plans[i]
+			switch p.Action {
+			case ActionCreated:
+				err = pr.AddProxy(ctx, p.proxy)
+			case ActionUpdated:
+				err = pr.UpdateProxy(ctx, p.proxy)
+			default:
+				continue
+			}
+			if err != nil {
+				p.Action, p.Reason = ActionFailed, err.Error()
+			}
+		}
+	}
+
+	report := &Report{Results: make([]Result, 0, len(plans))}
+	for _, p := range plans {
+		report.Results = append(report.Results, p.Result)
+		switch p.Action {
+		case ActionCreated:
+			report.Created++
+		case ActionUpdated:
+			report.Updated++
+		case ActionSkipped:
+			report.Skipped++
+		case ActionFailed:
+			report.Failed++
+		}
+	}
+
+	if conflicts > 0 {
+		return report, fmt.Errorf("%w: %d records", ErrConflict, conflicts)
+	}
+	return report, nil
+}
+
+// resolve turns a record into the proxy to import.
+func resolve(record Record, tags []string) (*router.ProxyConfig, error) {
+	line := strings.TrimSpace(record.Target)
+	if line == "" {
+		return nil, fmt.Errorf("no target")
+	}
+	if scheme := strings.TrimSuffix(record.Scheme, "://"); scheme != "" && !strings.Contains(line, "://") {
+		line = scheme + "://" + line
+	}
+
+	target, upstreamUser, upstreamPass, err := ParseLine(line)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if record.UpstreamUsername != "" || record.UpstreamPassword != "" {
+		upstreamUser, upstreamPass = record.UpstreamUsername, record.UpstreamPassword
+	}
+
+	tags, err = router.NormalizeTags(append(append([]string(nil), tags...), record.Tags...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &router.ProxyConfig{
+		Username:         record.Username,
+		Password:         record.Password,
+		Target:           target,
+		UpstreamUsername: upstreamUser,
+		UpstreamPassword: upstreamPass,
+		Tags:             tags,
+	}, nil
+}
+
+// conflict returns why proxy cannot be created, and the existing proxy it
+// may update instead, if any. A record naming a username only updates the
+// proxy of that username.
+func conflict(proxy *router.ProxyConfig, byUsername, byTarget map[string]*router.ProxyConfig, pools map[string]bool) (*router.ProxyConfig, string) {
+	if pools[proxy.Username] {
+		return nil, fmt.Sprintf("username %s belongs to a pool", proxy.Username)
+	}
+
+	sameUsername, sameTarget := byUsername[proxy.Username], byTarget[proxy.Target]
+	switch {
+	case sameUsername != nil && sameTarget != nil && sameUsername != sameTarget:
+		return nil, fmt.Sprintf("username exists, target belongs to %s", sameTarget.Username)
+	case sameUsername != nil:
+		return sameUsername, "username exists"
+	case sameTarget != nil && proxy.Username != "":
+		// The record names another user for this target, updating the
+		// owner of the target would ignore it.
+		return nil, fmt.Sprintf("target belongs to %s", sameTarget.Username)
+	case sameTarget != nil:
+		return sameTarget, fmt.Sprintf("target belongs to %s", sameTarget.Username)
+	}
+	return nil, ""
+}
@@ -0,0 +1,187 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stickpro/p-router/internal/repository"
+	"github.com/stickpro/p-router/internal/router"
+)
+
+func TestFetchAndParse(t *testing.T) {
+	files := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	t.Cleanup(files.Close)
+
+	structured := []Record{
+		{Target: "10.0.0.1:3128", Line: 1},
+		{Target: "10.0.0.2:3128", Username: "alice", Password: "secret", UpstreamUsername: "user", UpstreamPassword: "pass", Tags: []string{"de", "residential"}, Line: 2},
+		{Target: "10.0.0.3:1080", Scheme: "socks5", Tags: []string{"mobile"}, Line: 3},
+	}
+
+	tests := []struct {
+		file   string
+		format string
+		want   []Record
+	}{
+		{file: "proxies.txt", format: FormatText, want: []Record{
+			{Target: "10.0.0.1:3128", Line: 2},
+			{Target: "user:pass@10.0.0.2:3128", Line: 3},
+			{Target: "socks5://10.0.0.3:1080:user:pass", Line: 5},
+		}},
+		{file: "proxies.csv", format: FormatCSV},
+		{file: "proxies.json", format: FormatJSON, want: structured},
+		{file: "proxies.yaml", format: FormatYAML, want: structured},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, format, err := Fetch(context.Background(), files.Client(), files.URL+"/"+tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tt.format {
+				t.Fatalf("format %s, want %s", format, tt.format)
+			}
+
+			records, err := Parse(bytes.NewReader(data), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.want
+			if want == nil {
+				// CSV lines are shifted by the header.
+				want = make([]Record, len(structured))
+				for i, record := range structured {
+					record.Line++
+					want[i] = record
+				}
+			}
+			if !reflect.DeepEqual(records, want) {
+				t.Fatalf("got %+v\nwant %+v", records, want)
+			}
+		})
+	}
+
+	if _, _, err := Fetch(context.Background(), files.Client(), files.URL+"/missing.txt"); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+	if _, err := Parse(bytes.NewReader([]byte("host,port\n")), FormatCSV); !errors.Is(err, ErrInvalidFormat) {
+		t.Fatalf("expected ErrInvalidFormat, got %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	newRouter := func(t *testing.T) *router.ProxyRouter {
+		repo, err := repository.NewSQLiteRepository(filepath.Join(t.TempDir(), "proxies.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { repo.Close() })
+
+		pr := router.NewProxyRouter(repo)
+		if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: "old", Password: "x", Target: "10.0.0.1:3128"}); err != nil {
+			t.Fatal(err)
+		}
+		return pr
+	}
+
+	records := []Record{
+		{Target: "user:pass@10.0.0.1:3128", Line: 1},
+		{Target: "10.0.0.2:3128", Username: "new", Password: "y", Line: 2},
+		{Target: "10.0.0.2:3128", Line: 3},
+		{Target: "bogus", Line: 4},
+	}
+
+	actions := func(report *Report) []string {
+		var result []string
+		for _, r := range report.Results {
+			result = append(result, r.Action)
+		}
+		return result
+	}
+
+	tests := []struct {
+		mode    string
+		dryRun  bool
+		actions []string
+		created bool
+		updated bool
+		err     error
+	}{
+		{mode: OnConflictSkip, actions: []string{ActionSkipped, ActionCreated, ActionSkipped, ActionFailed}, created: true},
+		{mode: OnConflictUpdate, actions: []string{ActionUpdated, ActionCreated, ActionSkipped, ActionFailed}, created: true, updated: true},
+		{mode: OnConflictUpdate, dryRun: true, actions: []string{ActionUpdated, ActionCreated, ActionSkipped, ActionFailed}},
+		{mode: OnConflictFail, actions: []string{ActionFailed, ActionSkipped, ActionFailed, ActionFailed}, err: ErrConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			pr := newRouter(t)
+
+			report, err := Import(ctx, pr, records, Options{OnConflict: tt.mode, DryRun: tt.dryRun})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if got := actions(report); !reflect.DeepEqual(got, tt.actions) {
+				t.Fatalf("actions %v, want %v", got, tt.actions)
+			}
+
+			if _, err := pr.Resolve("new", "y"); (err == nil) != tt.created {
+				t.Fatalf("created %v, resolve error %v", tt.created, err)
+			}
+			old, err := pr.FindProxy(ctx, "old")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (old.UpstreamUsername == "user") != tt.updated {
+				t.Fatalf("updated %v, upstream username %q", tt.updated, old.UpstreamUsername)
+			}
+		})
+	}
+}
+
+func TestImportUpdateKeepsStoredFields(t *testing.T) {
+	ctx := context.Background()
+	repo, err := repository.NewSQLiteRepository(filepath.Join(t.TempDir(), "proxies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	pr := router.NewProxyRouter(repo)
+	if err := pr.AddProxy(ctx, &router.ProxyConfig{Username: "old", Password: "x", Target: "10.0.0.1:3128", UpstreamUsername: "u", UpstreamPassword: "p"}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Import(ctx, pr, []Record{{Target: "10.0.0.1:3128", Line: 1}}, Options{OnConflict: OnConflictUpdate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Updated != 1 {
+		t.Fatalf("expected an update, got %+v", report.Results)
+	}
+	old, err := pr.FindProxy(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.UpstreamUsername != "u" || old.UpstreamPassword != "p" {
+		t.Fatalf("upstream credentials lost: %q, %q", old.UpstreamUsername, old.UpstreamPassword)
+	}
+
+	// A record naming another user for the target is a conflict.
+	report, err = Import(ctx, pr, []Record{{Target: "10.0.0.1:3128", Username: "other", Line: 1}}, Options{OnConflict: OnConflictUpdate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Updated != 0 || report.Failed != 1 || report.Results[0].Username != "other" {
+		t.Fatalf("expected a conflict, got %+v", report.Results)
+	}
+}
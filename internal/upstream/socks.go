@@ -0,0 +1,319 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	socks4Version       = 0x04
+	socks4CmdConnect    = 0x01
+	socks4ReplyGranted  = 0x5a
+	socks4ReplyRejected = 0x5b
+
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthUserPass = 0x02
+	socks5AuthNoAccept = 0xff
+	socks5CmdConnect   = 0x01
+	socks5CmdUDP       = 0x03
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+)
+
+// ErrUDPNotSupported is returned when UDP is relayed through a proxy that
+// cannot carry it.
+var ErrUDPNotSupported = errors.New("proxy cannot relay UDP")
+
+var socks5ReplyMessages = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5DestinationReply reports whether reply blames the requested address:
+// refused by a ruleset, unreachable, refused or timed out. General failures
+// and unsupported commands or address types are the proxy's own.
+func socks5DestinationReply(reply byte) bool {
+	return reply >= 0x02 && reply <= 0x06
+}
+
+func splitHostPort(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+	return host, uint16(port), nil
+}
+
+// socks4Connect speaks SOCKS4a so hostnames are resolved by the upstream.
+func (p *Proxy) socks4Connect(conn net.Conn, addr string) (net.Conn, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := []byte{socks4Version, socks4CmdConnect}
+	req = binary.BigEndian.AppendUint16(req, port)
+
+	ip := net.ParseIP(host).To4()
+	if ip != nil {
+		req = append(req, ip...)
+	} else {
+		req = append(req, 0, 0, 0, 1)
+	}
+	req = append(req, p.Username...)
+	req = append(req, 0x00)
+	if ip == nil {
+		req = append(req, host...)
+		req = append(req, 0x00)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to send SOCKS4 request: %w", err)
+	}
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, fmt.Errorf("failed to read SOCKS4 reply: %w", err)
+	}
+	if reply[0] != 0x00 {
+		return nil, errMalformedReply
+	}
+	if reply[1] != socks4ReplyGranted {
+		return nil, &StatusError{
+			StatusCode:  http.StatusBadGateway,
+			Status:      fmt.Sprintf("socks4 request rejected (code %d)", reply[1]),
+			Destination: reply[1] == socks4ReplyRejected,
+		}
+	}
+
+	return conn, nil
+}
+
+func (p *Proxy) socks5Connect(conn net.Conn, addr string) (net.Conn, error) {
+	if err := p.socks5Greet(conn); err != nil {
+		return nil, err
+	}
+	if _, err := socks5Request(conn, socks5CmdConnect, addr); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socks5Greet negotiates the auth method and logs in when asked to.
+func (p *Proxy) socks5Greet(conn net.Conn) error {
+	methods := []byte{socks5AuthNone}
+	if p.Username != "" {
+		methods = append(methods, socks5AuthUserPass)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 greeting: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 greeting: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return errMalformedReply
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthUserPass:
+		return p.socks5Auth(conn)
+	case socks5AuthNoAccept:
+		return &StatusError{StatusCode: http.StatusBadGateway, Status: "socks5 proxy accepted no auth method"}
+	default:
+		return fmt.Errorf("unsupported SOCKS5 auth method %d", reply[1])
+	}
+}
+
+// socks5Request sends the command cmd for addr and returns the address the
+// proxy bound for it. A refusal is a StatusError carrying the reply code.
+func socks5Request(conn net.Conn, cmd byte, addr string) (string, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	req := []byte{socks5Version, cmd, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socks5AddrIPv4), ip4...)
+		} else {
+			req = append(append(req, socks5AddrIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return "", errors.New("hostname too long for SOCKS5")
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+
+	if _, err := conn.Write(req); err != nil {
+		return "", fmt.Errorf("failed to send SOCKS5 request: %w", err)
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+	}
+	if header[0] != socks5Version {
+		return "", errMalformedReply
+	}
+	if header[1] != 0x00 {
+		msg, ok := socks5ReplyMessages[header[1]]
+		if !ok {
+			msg = fmt.Sprintf("unknown error %d", header[1])
+		}
+		return "", &StatusError{
+			StatusCode:  http.StatusBadGateway,
+			Status:      "socks5: " + msg,
+			Reply:       header[1],
+			Destination: socks5DestinationReply(header[1]),
+		}
+	}
+
+	var bound string
+	switch header[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if header[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+		}
+		bound = ip.String()
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+		}
+		bound = string(domain)
+	default:
+		return "", errMalformedReply
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+	}
+
+	return net.JoinHostPort(bound, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes)))), nil
+}
+
+// UDPAssociation is a UDP relay opened on a SOCKS5 proxy. Datagrams to and
+// from RelayAddr carry the SOCKS5 UDP request header (RFC 1928, section 7).
+// The relay lives as long as the control connection it embeds.
+type UDPAssociation struct {
+	net.Conn
+	RelayAddr *net.UDPAddr
+}
+
+// AssociateUDP asks the proxy to relay UDP datagrams. Only SOCKS5 proxies
+// can, the others return ErrUDPNotSupported.
+func (p *Proxy) AssociateUDP(ctx context.Context) (*UDPAssociation, error) {
+	if p.Scheme != SchemeSOCKS5 {
+		return nil, ErrUDPNotSupported
+	}
+
+	conn, err := p.DialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := handshakeDeadline(ctx, conn)
+	relay, err := p.socks5Associate(conn)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return &UDPAssociation{Conn: conn, RelayAddr: relay}, nil
+}
+
+func (p *Proxy) socks5Associate(conn net.Conn) (*net.UDPAddr, error) {
+	if err := p.socks5Greet(conn); err != nil {
+		return nil, err
+	}
+
+	// The datagrams will come from this host, whose address as seen by the
+	// proxy is unknown, hence the unspecified one.
+	bound, err := socks5Request(conn, socks5CmdUDP, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCKS5 relay address %s: %w", bound, err)
+	}
+	// Relays bound to every interface are reached at the proxy address.
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = remote.IP
+		}
+	}
+
+	return relay, nil
+}
+
+func (p *Proxy) socks5Auth(conn net.Conn) error {
+	if p.Username == "" {
+		return &StatusError{StatusCode: http.StatusBadGateway, Status: "socks5 proxy requires credentials"}
+	}
+	if len(p.Username) > 255 || len(p.Password) > 255 {
+		return errors.New("SOCKS5 credentials too long")
+	}
+
+	req := []byte{0x01, byte(len(p.Username))}
+	req = append(req, p.Username...)
+	req = append(req, byte(len(p.Password)))
+	req = append(req, p.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 credentials: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 auth reply: %w", err)
+	}
+	if reply[1] != 0x00 {
+		return &StatusError{StatusCode: http.StatusBadGateway, Status: "socks5 authentication failed"}
+	}
+
+	return nil
+}
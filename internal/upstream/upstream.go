@@ -0,0 +1,239 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	SchemeHTTP   = "http"
+	SchemeHTTPS  = "https"
+	SchemeSOCKS4 = "socks4"
+	SchemeSOCKS5 = "socks5"
+
+	DialTimeout = 10 * time.Second
+)
+
+// Proxy describes an upstream proxy parsed from ProxyConfig.Target.
+type Proxy struct {
+	Scheme   string
+	Addr     string
+	Username string
+	Password string
+}
+
+// DialError is returned when the upstream proxy cannot be reached at all.
+type DialError struct {
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("cannot connect to proxy: %v", e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when the upstream proxy refuses to open a tunnel.
+// Reply is the reply code of SOCKS5 proxies that answered a request, zero
+// otherwise. Destination is set when the proxy works but refused or could not
+// reach the requested address, rather than failing itself.
+type StatusError struct {
+	StatusCode  int
+	Status      string
+	Reply       byte
+	Destination bool
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("proxy returned: %s", e.Status)
+}
+
+// Parse reads a target in the form scheme://[user:pass@]host:port.
+// A bare host:port keeps meaning an HTTP proxy.
+func Parse(target string) (*Proxy, error) {
+	if !strings.Contains(target, "://") {
+		target = SchemeHTTP + "://" + target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy target: %w", err)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	switch scheme {
+	case SchemeHTTP, SchemeHTTPS, SchemeSOCKS4, SchemeSOCKS5:
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy target %q must contain host and port", target)
+	}
+
+	p := &Proxy{
+		Scheme: scheme,
+		Addr:   u.Host,
+	}
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+
+	return p, nil
+}
+
+// ParseWithAuth is Parse for targets whose credentials are stored separately.
+// A non-empty username overrides credentials embedded in the target.
+func ParseWithAuth(target, username, password string) (*Proxy, error) {
+	p, err := Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "" {
+		p.Username = username
+		p.Password = password
+	}
+
+	return p, nil
+}
+
+// URL returns the proxy as an url.URL usable with http.ProxyURL.
+func (p *Proxy) URL() *url.URL {
+	u := &url.URL{Scheme: p.Scheme, Host: p.Addr}
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return u
+}
+
+// IsHTTP reports whether the proxy speaks HTTP (plain or TLS-wrapped).
+func (p *Proxy) IsHTTP() bool {
+	return p.Scheme == SchemeHTTP || p.Scheme == SchemeHTTPS
+}
+
+// AuthHeader returns the Proxy-Authorization value for HTTP proxies, or "" when no credentials are set.
+func (p *Proxy) AuthHeader() string {
+	if p.Username == "" {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(p.Username+":"+p.Password))
+}
+
+// DialProxy opens a connection to the proxy itself, wrapped in TLS for https proxies.
+func (p *Proxy) DialProxy(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, &DialError{Err: err}
+	}
+
+	if p.Scheme != SchemeHTTPS {
+		return conn, nil
+	}
+
+	host, _, _ := net.SplitHostPort(p.Addr)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, &DialError{Err: err}
+	}
+
+	return tlsConn, nil
+}
+
+// handshakeDeadline bounds the handshake on conn by the deadline of ctx, or
+// DialTimeout without one, and interrupts it once ctx is done. stop reports
+// false if ctx was done first, leaving conn unusable.
+func handshakeDeadline(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(DialTimeout))
+	}
+	return context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+// Dial opens a tunnel to addr through the proxy.
+func (p *Proxy) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := p.DialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := handshakeDeadline(ctx, conn)
+	var tunnel net.Conn
+	switch p.Scheme {
+	case SchemeSOCKS4:
+		tunnel, err = p.socks4Connect(conn, addr)
+	case SchemeSOCKS5:
+		tunnel, err = p.socks5Connect(conn, addr)
+	default:
+		tunnel, err = p.httpConnect(conn, addr)
+	}
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+func (p *Proxy) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if auth := p.AuthHeader(); auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy response: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{
+			StatusCode:  resp.StatusCode,
+			Status:      resp.Status,
+			Destination: resp.StatusCode != http.StatusProxyAuthRequired,
+		}
+	}
+
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn keeps bytes that were read ahead while parsing the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+var errMalformedReply = errors.New("malformed proxy reply")
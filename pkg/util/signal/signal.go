@@ -11,3 +11,8 @@ func Shutdown() []os.Signal {
 		syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGKILL,
 	}
 }
+
+// Reload returns the signals that make a running service reload its state from storage.
+func Reload() []os.Signal {
+	return []os.Signal{syscall.SIGHUP}
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"math"
 	"reflect"
 	"runtime"
@@ -119,3 +121,10 @@ func StructToMap(data any) ([]map[string]interface{}, error) {
 
 	return result, nil
 }
+
+// RandomString returns n random hex characters, e.g. for generated credentials.
+func RandomString(n int) string {
+	b := make([]byte, (n+1)/2)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)[:n]
+}